@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+var aliases = map[string]string{}
+
+func Alias(command []string, std streams) int {
+	args := command[1:]
+	if len(args) > 0 && args[0] == "-p" {
+		args = args[1:]
+	}
+	var output strings.Builder
+	if len(args) == 0 {
+		names := make([]string, 0, len(aliases))
+		for name := range aliases {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		for _, name := range names {
+			output.WriteString(aliasDefinition(name))
+		}
+		return std.print("alias", output.String())
+	}
+	status := 0
+	for _, arg := range args {
+		name, value, assign := strings.Cut(arg, "=")
+		if !assign {
+			if _, ok := aliases[name]; !ok {
+				fmt.Fprintf(std.err, "gosh: alias: %s: not found\n", name)
+				status = 1
+				continue
+			}
+			output.WriteString(aliasDefinition(name))
+			continue
+		}
+		if name == "" || strings.ContainsAny(name, " \t\n/$`=|&;()<>'\"\\") {
+			fmt.Fprintf(std.err, "gosh: alias: `%s': invalid alias name\n", name)
+			status = 1
+			continue
+		}
+		aliases[name] = value
+	}
+	if std.print("alias", output.String()) != 0 {
+		return 1
+	}
+	return status
+}
+
+func aliasDefinition(name string) string {
+	return fmt.Sprintf("alias %s='%s'\n", name, strings.ReplaceAll(aliases[name], "'", `'\''`))
+}
+
+func Unalias(command []string, std streams) int {
+	if len(command) == 1 {
+		fmt.Fprintln(std.err, "unalias: usage: unalias [-a] name [name ...]")
+		return 2
+	}
+	status := 0
+	for _, name := range command[1:] {
+		if name == "-a" {
+			clear(aliases)
+			continue
+		}
+		if _, ok := aliases[name]; !ok {
+			fmt.Fprintf(std.err, "gosh: unalias: %s: not found\n", name)
+			status = 1
+			continue
+		}
+		delete(aliases, name)
+	}
+	return status
+}
+
+// expandAlias replaces the word about to be read as a command name with
+// the tokens of its alias, repeatedly, but never expanding an alias within
+// its own expansion. When an alias ends in a blank the word after it is
+// checked as well. Aliases are expanded only with shopt expand_aliases,
+// which is set in an interactive shell, as bash does.
+func (p *parser) expandAlias() {
+	if !shoptOptions["expand_aliases"] {
+		return
+	}
+	expanded := map[string]bool{}
+	for pos := p.pos; pos < len(p.tokens); {
+		end, blank := pos, false
+		for {
+			tok := p.tokens[pos]
+			if tok.kind != tokWord || len(tok.word) != 1 || tok.word[0].quote != 0 {
+				break
+			}
+			value, ok := aliases[tok.text]
+			if !ok || expanded[tok.text] {
+				break
+			}
+			expanded[tok.text] = true
+			tokens, err := commandParser(value)
+			if err != nil {
+				break
+			}
+			tokens = tokens[:len(tokens)-1] // drop the EOF token
+			for i := range tokens {
+				tokens[i].pos = tok.pos
+			}
+			p.tokens = slices.Concat(p.tokens[:pos], tokens, p.tokens[pos+1:])
+			end = max(end+len(tokens)-1, pos+len(tokens))
+			blank = blank || (value != "" && isBlank(value[len(value)-1]))
+			if len(tokens) == 0 {
+				break
+			}
+		}
+		if !blank {
+			return
+		}
+		pos = end
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"syscall"
+)
+
+// streams are the standard input, output and error a builtin reads and
+// writes. files holds the descriptors behind them, for the builtins that
+// run other commands.
+type streams struct {
+	in    io.Reader
+	out   io.Writer
+	err   io.Writer
+	files stdio
+}
+
+// builtinFunc runs a builtin with its name in command[0] and returns its
+// exit status.
+type builtinFunc func(command []string, std streams) int
+
+var builtins map[string]builtinFunc
+
+func init() {
+	builtins = map[string]builtinFunc{
+		"echo":     Echo,
+		"exit":     Exit,
+		"logout":   Logout,
+		"jobs":     Jobs,
+		"kill":     Kill,
+		"disown":   Disown,
+		"shopt":    Shopt,
+		"trap":     Trap,
+		"pwd":      Pwd,
+		"type":     Type,
+		"cd":       Cd,
+		"history":  History,
+		"printf":   Printf,
+		"read":     Read,
+		"set":      Set,
+		"declare":  func(command []string, std streams) int { return Declare(command, nil, std) },
+		"typeset":  func(command []string, std streams) int { return Declare(command, nil, std) },
+		"unset":    Unset,
+		"eval":     Eval,
+		"exec":     Exec,
+		"return":   Return,
+		"break":    Break,
+		"continue": Break,
+		"hash":     Hash,
+		"command":  Command,
+		"builtin":  Builtin,
+		"alias":    Alias,
+		"unalias":  Unalias,
+		"dirs":     Dirs,
+		"pushd":    Pushd,
+		"popd":     Popd,
+		"times":    Times,
+		"ulimit":   Ulimit,
+		"umask":    Umask,
+		"welcome":  func([]string, streams) int { Welcome(); return 0 },
+	}
+}
+
+// errBadFd is what reading or writing a closed standard stream gives.
+var errBadFd = errors.New("Bad file descriptor")
+
+type closedStream struct{}
+
+func (closedStream) Read([]byte) (int, error)  { return 0, errBadFd }
+func (closedStream) Write([]byte) (int, error) { return 0, errBadFd }
+
+func (std stdio) streams() streams {
+	s := streams{closedStream{}, closedStream{}, closedStream{}, std}
+	if std.in != nil {
+		s.in = std.in
+	}
+	if std.out != nil {
+		s.out = std.out
+	}
+	if std.err != nil {
+		s.err = std.err
+	}
+	return s
+}
+
+func runBuiltin(command []string, std stdio) int {
+	return builtins[command[0]](command, std.streams())
+}
+
+func Exit(command []string, std streams) int {
+	status := lastStatus
+	if len(command) > 1 {
+		n, err := strconv.Atoi(command[1])
+		if err != nil {
+			fmt.Fprintf(std.err, "gosh: exit: %s: numeric argument required\n", command[1])
+			n = 2
+		}
+		status = n & 0xff
+	}
+	if std.files.ctl == mainControl && warnAboutJobs(std) {
+		return 1
+	}
+	std.files.ctl.exit = true
+	return status
+}
+
+// Logout is exit for a login shell.
+func Logout(command []string, std streams) int {
+	if !loginShell {
+		fmt.Fprintln(std.err, "gosh: logout: not login shell: use `exit'")
+		return 1
+	}
+	return Exit(command, std)
+}
+
+func Return(command []string, std streams) int {
+	std.files.ctl.funcReturn = true
+	status := lastStatus
+	if len(command) > 1 {
+		status, _ = strconv.Atoi(command[1])
+	}
+	return status
+}
+
+// Break implements both break and continue, which leave or restart the
+// Nth enclosing loop.
+func Break(command []string, std streams) int {
+	levels := 1
+	if len(command) > 1 {
+		if n, err := strconv.Atoi(command[1]); err == nil && n > 0 {
+			levels = n
+		}
+	}
+	if command[0] == "break" {
+		std.files.ctl.breakLevels = levels
+	} else {
+		std.files.ctl.continueLevels = levels
+	}
+	return 0
+}
+
+func Exec(command []string, std streams) int {
+	if len(command) == 1 {
+		return 0
+	}
+	return execCommand(command[1:], std.files)
+}
+
+func Builtin(command []string, std streams) int {
+	if len(command) == 1 {
+		return 0
+	}
+	fn := builtins[command[1]]
+	if fn == nil {
+		fmt.Fprintf(std.err, "gosh: builtin: %s: not a shell builtin\n", command[1])
+		return 1
+	}
+	return fn(command[1:], std)
+}
+
+// print writes s to the standard output, reporting a failed write as
+// shells do for a closed output. A broken pipe ends the builtin quietly,
+// with the status of a command killed by SIGPIPE.
+func (std streams) print(name string, s string) int {
+	if _, err := io.WriteString(std.out, s); err != nil {
+		if errors.Is(err, syscall.EPIPE) {
+			return 128 + int(syscall.SIGPIPE)
+		}
+		fmt.Fprintf(std.err, "gosh: %s: write error: %s\n", name, errorText(unwrapPathError(err)))
+		return 1
+	}
+	return 0
+}
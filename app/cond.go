@@ -0,0 +1,340 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// condCmd is the [[ ]] conditional command.
+type condCmd struct {
+	expr *condExpr
+}
+
+// condExpr is an expression of [[ ]]: !, && or || applied to exprs, or a
+// test such as -f or == applied to words. A lone word is tested with -n.
+type condExpr struct {
+	op    string
+	exprs []*condExpr
+	words []word
+}
+
+var condUnaryOps = []string{
+	"-a", "-b", "-c", "-d", "-e", "-f", "-g", "-h", "-k", "-L", "-n", "-o",
+	"-p", "-r", "-s", "-S", "-t", "-u", "-v", "-w", "-x", "-z",
+}
+
+var condBinaryOps = []string{
+	"==", "=", "!=", "=~", "<", ">",
+	"-eq", "-ne", "-lt", "-le", "-gt", "-ge", "-nt", "-ot", "-ef",
+}
+
+// parseCond reads [[ expression ]]. Inside it && and || join tests and <
+// and > compare strings rather than redirect.
+func (p *parser) parseCond() (node, error) {
+	p.next()
+	expr, err := p.parseCondOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); !isReserved(tok, "]]") {
+		return nil, p.unexpected(tok)
+	}
+	p.next()
+	return &condCmd{expr: expr}, nil
+}
+
+func (p *parser) parseCondOr() (*condExpr, error) {
+	left, err := p.parseCondAnd()
+	for err == nil && p.isOp("||") {
+		p.next()
+		p.skipNewlines()
+		var right *condExpr
+		right, err = p.parseCondAnd()
+		left = &condExpr{op: "||", exprs: []*condExpr{left, right}}
+	}
+	return left, err
+}
+
+func (p *parser) parseCondAnd() (*condExpr, error) {
+	left, err := p.parseCondNot()
+	for err == nil && p.isOp("&&") {
+		p.next()
+		p.skipNewlines()
+		var right *condExpr
+		right, err = p.parseCondNot()
+		left = &condExpr{op: "&&", exprs: []*condExpr{left, right}}
+	}
+	return left, err
+}
+
+func (p *parser) parseCondNot() (*condExpr, error) {
+	if isReserved(p.peek(), "!") {
+		p.next()
+		expr, err := p.parseCondNot()
+		return &condExpr{op: "!", exprs: []*condExpr{expr}}, err
+	}
+	return p.parseCondPrimary()
+}
+
+func (p *parser) parseCondPrimary() (*condExpr, error) {
+	if p.isOp("(") {
+		p.next()
+		expr, err := p.parseCondOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.isOp(")") {
+			return nil, p.unexpected(p.peek())
+		}
+		p.next()
+		return expr, nil
+	}
+	tok := p.peek()
+	if tok.kind != tokWord || isReserved(tok, "]]") {
+		return nil, p.unexpected(tok)
+	}
+	p.next()
+	if operand := p.peek(); tok.word[0].quote == 0 && slices.Contains(condUnaryOps, tok.text) &&
+		operand.kind == tokWord && !isReserved(operand, "]]") {
+		p.next()
+		return &condExpr{op: tok.text, words: []word{operand.word}}, nil
+	}
+
+	op := p.peek()
+	if op.kind == tokWord && op.word[0].quote == 0 && slices.Contains(condBinaryOps, op.text) ||
+		op.kind == tokOp && (op.text == "<" || op.text == ">") {
+		p.next()
+		if op.text == "=~" {
+			p.joinRegex()
+		}
+		right := p.peek()
+		if right.kind != tokWord || isReserved(right, "]]") {
+			return nil, p.unexpected(right)
+		}
+		p.next()
+		return &condExpr{op: op.text, words: []word{tok.word, right.word}}, nil
+	}
+	return &condExpr{op: "-n", words: []word{tok.word}}, nil
+}
+
+// joinRegex makes one word of the regular expression after =~, which the
+// lexer has split wherever it holds an operator character such as ( or |.
+// The tokens it is made of are those that follow each other without a
+// blank between.
+func (p *parser) joinRegex() {
+	end := p.pos
+	for end < len(p.tokens) {
+		tok := p.tokens[end]
+		if tok.kind != tokWord && !(tok.kind == tokOp && tok.text != "&&" && tok.text != "||") {
+			break
+		}
+		if end > p.pos {
+			prev := p.tokens[end-1]
+			if tok.pos != prev.pos+len(prev.text) {
+				break
+			}
+		}
+		end++
+	}
+	if end-p.pos < 2 {
+		return
+	}
+	joined := token{kind: tokWord, pos: p.tokens[p.pos].pos}
+	for _, tok := range p.tokens[p.pos:end] {
+		joined.text += tok.text
+		if tok.kind == tokWord {
+			joined.word = append(joined.word, tok.word...)
+		} else {
+			joined.word = append(joined.word, wordPart{text: tok.text})
+		}
+	}
+	p.tokens = slices.Concat(p.tokens[:p.pos], []token{joined}, p.tokens[end:])
+}
+
+// execCond runs [[ ]], which is true with status 0, false with 1, and 2
+// when the expression cannot be evaluated.
+func execCond(c *condCmd, std stdio) int {
+	result, err := evalCond(c.expr)
+	if expansionFailed {
+		return expansionError(std)
+	}
+	if err != nil {
+		fmt.Fprintf(std.err, "gosh: %s\n", err)
+		return 2
+	}
+	if result {
+		return 0
+	}
+	return 1
+}
+
+func evalCond(e *condExpr) (bool, error) {
+	switch e.op {
+	case "!":
+		result, err := evalCond(e.exprs[0])
+		return !result, err
+	case "&&", "||":
+		result, err := evalCond(e.exprs[0])
+		if err != nil || result == (e.op == "||") {
+			return result, err
+		}
+		return evalCond(e.exprs[1])
+	}
+	if len(e.words) == 1 {
+		return condUnary(e.op, expandString(e.words[0]))
+	}
+
+	left := expandString(e.words[0])
+	switch e.op {
+	case "==", "=":
+		return matchPattern(condPattern(e.words[1]), left), nil
+	case "!=":
+		return !matchPattern(condPattern(e.words[1]), left), nil
+	case "=~":
+		return matchRegex(left, e.words[1])
+	}
+	right := expandString(e.words[1])
+	switch e.op {
+	case "<":
+		return left < right, nil
+	case ">":
+		return left > right, nil
+	case "-nt", "-ot":
+		leftInfo, leftErr := os.Stat(left)
+		rightInfo, rightErr := os.Stat(right)
+		if e.op == "-ot" {
+			leftInfo, leftErr, rightInfo, rightErr = rightInfo, rightErr, leftInfo, leftErr
+		}
+		if leftErr != nil {
+			return false, nil
+		}
+		return rightErr != nil || leftInfo.ModTime().After(rightInfo.ModTime()), nil
+	case "-ef":
+		leftInfo, leftErr := os.Stat(left)
+		rightInfo, rightErr := os.Stat(right)
+		return leftErr == nil && rightErr == nil && os.SameFile(leftInfo, rightInfo), nil
+	}
+
+	a, ok := evalIndex(left)
+	if !ok {
+		return false, fmt.Errorf("%s: integer expression expected", left)
+	}
+	b, ok := evalIndex(right)
+	if !ok {
+		return false, fmt.Errorf("%s: integer expression expected", right)
+	}
+	switch e.op {
+	case "-eq":
+		return a == b, nil
+	case "-ne":
+		return a != b, nil
+	case "-lt":
+		return a < b, nil
+	case "-le":
+		return a <= b, nil
+	case "-gt":
+		return a > b, nil
+	}
+	return a >= b, nil
+}
+
+func condUnary(op, arg string) (bool, error) {
+	switch op {
+	case "-n":
+		return arg != "", nil
+	case "-z":
+		return arg == "", nil
+	case "-o":
+		return shellOptions[arg], nil
+	case "-v":
+		if _, set := lookupVar(arg); set {
+			return true, nil
+		}
+		return getArray(arg) != nil, nil
+	case "-t":
+		fd, ok := evalIndex(arg)
+		if !ok {
+			return false, nil
+		}
+		_, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+		return err == nil, nil
+	case "-r":
+		return unix.Access(arg, unix.R_OK) == nil, nil
+	case "-w":
+		return unix.Access(arg, unix.W_OK) == nil, nil
+	case "-x":
+		return unix.Access(arg, unix.X_OK) == nil, nil
+	case "-h", "-L":
+		info, err := os.Lstat(arg)
+		return err == nil && info.Mode()&os.ModeSymlink != 0, nil
+	}
+
+	info, err := os.Stat(arg)
+	if err != nil {
+		return false, nil
+	}
+	mode := info.Mode()
+	switch op {
+	case "-b":
+		return mode&os.ModeDevice != 0 && mode&os.ModeCharDevice == 0, nil
+	case "-c":
+		return mode&os.ModeCharDevice != 0, nil
+	case "-d":
+		return mode.IsDir(), nil
+	case "-f":
+		return mode.IsRegular(), nil
+	case "-g":
+		return mode&os.ModeSetgid != 0, nil
+	case "-k":
+		return mode&os.ModeSticky != 0, nil
+	case "-p":
+		return mode&os.ModeNamedPipe != 0, nil
+	case "-s":
+		return info.Size() > 0, nil
+	case "-S":
+		return mode&os.ModeSocket != 0, nil
+	case "-u":
+		return mode&os.ModeSetuid != 0, nil
+	}
+	return true, nil // -a and -e
+}
+
+// condPattern expands the pattern on the right of == or !=, in which
+// quoted characters match themselves.
+func condPattern(w word) string {
+	var pattern strings.Builder
+	for _, part := range w {
+		text := expandString(word{part})
+		if part.quote != 0 {
+			text = escapeGlob(text)
+		}
+		pattern.WriteString(text)
+	}
+	return pattern.String()
+}
+
+// matchRegex matches s against the extended regular expression w, quoted
+// parts of which match themselves. The match and the text of each group
+// are left in BASH_REMATCH, which is emptied when s does not match.
+func matchRegex(s string, w word) (bool, error) {
+	var expr strings.Builder
+	for _, part := range w {
+		text := expandString(word{part})
+		if part.quote != 0 {
+			text = regexp.QuoteMeta(text)
+		}
+		expr.WriteString(text)
+	}
+	re, err := regexp.CompilePOSIX(expr.String())
+	if err != nil {
+		return false, fmt.Errorf("%s: invalid regular expression", expr.String())
+	}
+	match := re.FindStringSubmatch(s)
+	setArray("BASH_REMATCH", arrayFromList(match))
+	return match != nil, nil
+}
@@ -0,0 +1,13 @@
+package main
+
+import "testing"
+
+func TestRegexMatchSetsBashRematch(t *testing.T) {
+	stdout, _, _ := runGosh(t, `x=abc123
+[[ $x =~ ^([a-z]+)([0-9]+)$ ]] && echo "${BASH_REMATCH[0]} ${BASH_REMATCH[1]} ${BASH_REMATCH[2]}"
+[[ $x =~ "[a-z]+" ]]; echo "$? ${#BASH_REMATCH[@]}"
+`)
+	if want := "abc123 abc 123\n1 0\n"; stdout != want {
+		t.Errorf("got %q, want %q", stdout, want)
+	}
+}
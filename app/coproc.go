@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+)
+
+// coprocFds are the shell's ends of coprocess pipes. Like shellFds they
+// can be used in redirections, but they are not passed on to the commands
+// the shell starts, so that a coprocess sees end of file once the shell
+// closes its input.
+var coprocFds = map[int]*os.File{}
+
+// freeFd picks the descriptor number for a coprocess pipe, counting down
+// from 63 as bash does.
+func freeFd() int {
+	fd := 63
+	for {
+		_, shell := shellFds[fd]
+		_, coproc := coprocFds[fd]
+		if !shell && !coproc {
+			return fd
+		}
+		fd--
+	}
+}
+
+// startCoproc starts a coprocess as a job and sets NAME to its output and
+// input descriptors and NAME_PID to its process id.
+func startCoproc(c *coproc, std stdio) int {
+	inR, inW, err := os.Pipe()
+	if err != nil {
+		fmt.Fprintf(std.err, "gosh: coproc: %s\n", errorText(err))
+		return 1
+	}
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		inR.Close()
+		inW.Close()
+		fmt.Fprintf(std.err, "gosh: coproc: %s\n", errorText(err))
+		return 1
+	}
+
+	std.in, std.out = inR, outW
+	startJob(c.text, "coproc "+c.name+" "+c.text, std, inR, outW)
+
+	readFd := freeFd()
+	coprocFds[readFd] = outR
+	writeFd := freeFd()
+	coprocFds[writeFd] = inW
+	setArray(c.name, arrayFromList([]string{strconv.Itoa(readFd), strconv.Itoa(writeFd)}))
+	setVar(c.name+"_PID", strconv.Itoa(lastPid))
+	return 0
+}
+
+// closeCoprocFd closes a coprocess descriptor the shell no longer wants,
+// as exec N>&- does. It reports whether fd was one.
+func closeCoprocFd(fd int) bool {
+	file, ok := coprocFds[fd]
+	if ok {
+		file.Close()
+		delete(coprocFds, fd)
+	}
+	return ok
+}
+
+// isCoprocFile reports whether file is the shell's end of a coprocess
+// pipe, which redirections must leave open.
+func isCoprocFile(file *os.File) bool {
+	return slices.Contains(slices.Collect(maps.Values(coprocFds)), file)
+}
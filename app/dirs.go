@@ -0,0 +1,423 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// initPwd makes sure PWD names the current directory, keeping an
+// inherited PWD that reaches it through symlinks.
+func initPwd() {
+	if pwd := os.Getenv("PWD"); filepath.IsAbs(pwd) && sameFile(pwd, ".") {
+		return
+	}
+	if pwd, err := unix.Getwd(); err == nil {
+		os.Setenv("PWD", pwd)
+	}
+}
+
+func sameFile(a, b string) bool {
+	infoA, errA := os.Stat(a)
+	infoB, errB := os.Stat(b)
+	return errA == nil && errB == nil && os.SameFile(infoA, infoB)
+}
+
+// logicalPwd returns PWD when it still names the current directory, or
+// the physical path when it does not.
+func logicalPwd() (string, error) {
+	if pwd := os.Getenv("PWD"); filepath.IsAbs(pwd) && sameFile(pwd, ".") {
+		return pwd, nil
+	}
+	return unix.Getwd()
+}
+
+func Pwd(command []string, std streams) int {
+	physical := false
+	for _, arg := range command[1:] {
+		switch arg {
+		case "-L":
+			physical = false
+		case "-P":
+			physical = true
+		default:
+			fmt.Fprintf(std.err, "gosh: pwd: %s: invalid option\n", arg)
+			fmt.Fprintln(std.err, "pwd: usage: pwd [-LP]")
+			return 2
+		}
+	}
+	path, err := logicalPwd()
+	if physical {
+		path, err = unix.Getwd()
+	}
+	if err != nil {
+		fmt.Fprintf(std.err, "gosh: pwd: error retrieving current directory: %s\n", err)
+		return 1
+	}
+	return std.print("pwd", path+"\n")
+}
+
+func Cd(command []string, std streams) int {
+	args := command[1:]
+	physical := false
+	for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+		if args[0] == "--" {
+			args = args[1:]
+			break
+		}
+		for _, flag := range args[0][1:] {
+			switch flag {
+			case 'L':
+				physical = false
+			case 'P':
+				physical = true
+			default:
+				fmt.Fprintf(std.err, "gosh: cd: -%c: invalid option\n", flag)
+				fmt.Fprintln(std.err, "cd: usage: cd [-L|-P] [dir]")
+				return 2
+			}
+		}
+		args = args[1:]
+	}
+	if len(args) > 1 {
+		fmt.Fprintln(std.err, "gosh: cd: too many arguments")
+		return 1
+	}
+
+	var dir string
+	show := false
+	switch {
+	case len(args) == 0:
+		home, set := os.LookupEnv("HOME")
+		if !set {
+			fmt.Fprintln(std.err, "gosh: cd: HOME not set")
+			return 1
+		}
+		dir = home
+	case args[0] == "-":
+		oldpwd, set := os.LookupEnv("OLDPWD")
+		if !set {
+			fmt.Fprintln(std.err, "gosh: cd: OLDPWD not set")
+			return 1
+		}
+		dir, show = oldpwd, true
+	default:
+		dir = args[0]
+		if found, ok := searchCdpath(dir); ok {
+			dir, show = found, true
+		}
+	}
+	if dir == "" {
+		return 0
+	}
+
+	pwd, err := changeDir(dir, physical)
+	if err != nil {
+		fmt.Fprintf(std.err, "gosh: cd: %s: %s\n", dir, err)
+		return 1
+	}
+	if show {
+		return std.print("cd", pwd+"\n")
+	}
+	return 0
+}
+
+// searchCdpath looks for a relative dir under each CDPATH entry. It only
+// reports the directories found through a non-empty entry, which cd
+// prints.
+func searchCdpath(dir string) (string, bool) {
+	cdpath := os.Getenv("CDPATH")
+	if cdpath == "" || filepath.IsAbs(dir) || dir == "." || dir == ".." ||
+		strings.HasPrefix(dir, "./") || strings.HasPrefix(dir, "../") {
+		return "", false
+	}
+	for _, entry := range strings.Split(cdpath, ":") {
+		if entry == "" {
+			if info, err := os.Stat(dir); err == nil && info.IsDir() {
+				return "", false
+			}
+			continue
+		}
+		candidate := filepath.Join(entry, dir)
+		if info, err := os.Stat(candidate); err == nil && info.IsDir() {
+			return candidate, true
+		}
+	}
+	return "", false
+}
+
+// changeDir moves to dir and updates PWD and OLDPWD, returning the new
+// PWD. Logically, dir is taken relative to PWD with .. removing the last
+// component, so the way in through a symlink is kept; physically all
+// symlinks are resolved.
+func changeDir(dir string, physical bool) (string, error) {
+	oldpwd, err := logicalPwd()
+	if err != nil {
+		oldpwd = os.Getenv("PWD")
+	}
+
+	target := dir
+	if !physical {
+		if !filepath.IsAbs(target) && oldpwd != "" {
+			target = filepath.Join(oldpwd, target)
+		}
+		target = filepath.Clean(target)
+	}
+	if err := os.Chdir(target); err != nil {
+		return "", errors.New(errorText(unwrapPathError(err)))
+	}
+
+	pwd := target
+	if physical || !filepath.IsAbs(pwd) {
+		if pwd, err = unix.Getwd(); err != nil {
+			return "", err
+		}
+	}
+	os.Setenv("OLDPWD", oldpwd)
+	os.Setenv("PWD", pwd)
+	return pwd, nil
+}
+
+// dirStack holds the directories pushd saved, most recent first. The
+// current directory is always the top of the stack as dirs shows it, and
+// is not stored here.
+var dirStack []string
+
+// fullStack is the stack as dirs numbers it, starting with PWD.
+func fullStack() []string {
+	pwd, err := logicalPwd()
+	if err != nil {
+		pwd = os.Getenv("PWD")
+	}
+	return append([]string{pwd}, dirStack...)
+}
+
+// stackIndex converts a +N or -N argument into an index of fullStack,
+// counting from the left or the right.
+func stackIndex(arg string, size int) (int, bool) {
+	if len(arg) < 2 || (arg[0] != '+' && arg[0] != '-') || !isDigits(arg[1:]) {
+		return 0, false
+	}
+	n, err := strconv.Atoi(arg[1:])
+	if err != nil || n >= size {
+		return -1, true
+	}
+	if arg[0] == '-' {
+		n = size - 1 - n
+	}
+	return n, true
+}
+
+// tildeDir returns the directory ~N, ~+N or ~-N refers to, where prefix
+// is the text after the ~.
+func tildeDir(prefix string) (string, bool) {
+	if isDigits(prefix) {
+		prefix = "+" + prefix
+	}
+	stack := fullStack()
+	n, ok := stackIndex(prefix, len(stack))
+	if !ok || n < 0 {
+		return "", false
+	}
+	return stack[n], true
+}
+
+func Dirs(command []string, std streams) int {
+	long, perLine, numbered := false, false, false
+	index := -1
+	for _, arg := range command[1:] {
+		if n, ok := stackIndex(arg, len(dirStack)+1); ok {
+			if n < 0 {
+				fmt.Fprintf(std.err, "gosh: dirs: %s: directory stack index out of range\n", arg)
+				return 1
+			}
+			index = n
+			continue
+		}
+		if len(arg) < 2 || arg[0] != '-' {
+			fmt.Fprintf(std.err, "gosh: dirs: %s: invalid argument\n", arg)
+			fmt.Fprintln(std.err, "dirs: usage: dirs [-clpv] [+N] [-N]")
+			return 2
+		}
+		for _, flag := range arg[1:] {
+			switch flag {
+			case 'c':
+				dirStack = nil
+			case 'l':
+				long = true
+			case 'p':
+				perLine = true
+			case 'v':
+				perLine, numbered = true, true
+			default:
+				fmt.Fprintf(std.err, "gosh: dirs: -%c: invalid option\n", flag)
+				fmt.Fprintln(std.err, "dirs: usage: dirs [-clpv] [+N] [-N]")
+				return 2
+			}
+		}
+	}
+	if slices.Contains(command[1:], "-c") {
+		return 0
+	}
+
+	stack := fullStack()
+	if !long {
+		for i, dir := range stack {
+			stack[i] = abbreviateHome(dir)
+		}
+	}
+	if index >= 0 {
+		return std.print("dirs", stack[index]+"\n")
+	}
+	return std.print("dirs", formatStack(stack, perLine, numbered))
+}
+
+func formatStack(stack []string, perLine, numbered bool) string {
+	if !perLine {
+		return strings.Join(stack, " ") + "\n"
+	}
+	var output strings.Builder
+	for i, dir := range stack {
+		if numbered {
+			fmt.Fprintf(&output, "%2d  ", i)
+		}
+		output.WriteString(dir + "\n")
+	}
+	return output.String()
+}
+
+// abbreviateHome writes a path under HOME with a leading ~, as dirs shows
+// it.
+func abbreviateHome(dir string) string {
+	home := os.Getenv("HOME")
+	if home == "" || home == "/" {
+		return dir
+	}
+	if dir == home {
+		return "~"
+	}
+	if rest, ok := strings.CutPrefix(dir, home+"/"); ok {
+		return "~/" + rest
+	}
+	return dir
+}
+
+func showStack() string {
+	stack := fullStack()
+	for i, dir := range stack {
+		stack[i] = abbreviateHome(dir)
+	}
+	return formatStack(stack, false, false)
+}
+
+func Pushd(command []string, std streams) int {
+	args := command[1:]
+	noChange := false
+	if len(args) > 0 && args[0] == "-n" {
+		noChange = true
+		args = args[1:]
+	}
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+	stack := fullStack()
+
+	switch {
+	case len(args) == 0:
+		if len(dirStack) == 0 {
+			fmt.Fprintln(std.err, "gosh: pushd: no other directory")
+			return 1
+		}
+		if noChange {
+			return std.print("pushd", showStack())
+		}
+		next := dirStack[0]
+		if _, err := changeDir(next, false); err != nil {
+			fmt.Fprintf(std.err, "gosh: pushd: %s: %s\n", next, err)
+			return 1
+		}
+		dirStack[0] = stack[0]
+	default:
+		if n, ok := stackIndex(args[0], len(stack)); ok {
+			if n < 0 {
+				fmt.Fprintf(std.err, "gosh: pushd: %s: directory stack index out of range\n", args[0])
+				return 1
+			}
+			// Rotate the stack so that entry n is on top.
+			rotated := append(stack[n:], stack[:n]...)
+			if noChange {
+				return std.print("pushd", showStack())
+			}
+			if _, err := changeDir(rotated[0], false); err != nil {
+				fmt.Fprintf(std.err, "gosh: pushd: %s: %s\n", rotated[0], err)
+				return 1
+			}
+			dirStack = rotated[1:]
+			break
+		}
+		dir := args[0]
+		if noChange {
+			abs := dir
+			if !filepath.IsAbs(abs) {
+				abs = filepath.Join(stack[0], abs)
+			}
+			dirStack = append([]string{abs}, dirStack...)
+			return std.print("pushd", showStack())
+		}
+		if _, err := changeDir(dir, false); err != nil {
+			fmt.Fprintf(std.err, "gosh: pushd: %s: %s\n", dir, err)
+			return 1
+		}
+		dirStack = append([]string{stack[0]}, dirStack...)
+	}
+	return std.print("pushd", showStack())
+}
+
+func Popd(command []string, std streams) int {
+	args := command[1:]
+	noChange := false
+	if len(args) > 0 && args[0] == "-n" {
+		noChange = true
+		args = args[1:]
+	}
+	if len(dirStack) == 0 {
+		fmt.Fprintln(std.err, "gosh: popd: directory stack empty")
+		return 1
+	}
+	stack := fullStack()
+
+	n := 0
+	if len(args) > 0 {
+		index, ok := stackIndex(args[0], len(stack))
+		if !ok {
+			fmt.Fprintf(std.err, "gosh: popd: %s: invalid argument\n", args[0])
+			fmt.Fprintln(std.err, "popd: usage: popd [-n] [+N | -N]")
+			return 2
+		}
+		if index < 0 {
+			fmt.Fprintf(std.err, "gosh: popd: %s: directory stack index out of range\n", args[0])
+			return 1
+		}
+		n = index
+	}
+
+	if n == 0 && noChange {
+		n = 1
+	}
+	if n > 0 {
+		dirStack = slices.Delete(dirStack, n-1, n)
+		return std.print("popd", showStack())
+	}
+	if _, err := changeDir(dirStack[0], false); err != nil {
+		fmt.Fprintf(std.err, "gosh: popd: %s: %s\n", dirStack[0], err)
+		return 1
+	}
+	dirStack = dirStack[1:]
+	return std.print("popd", showStack())
+}
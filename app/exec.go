@@ -0,0 +1,624 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+type stdio struct {
+	in, out, err *os.File
+	// fds holds the descriptors above 2, which reach child processes
+	// through ExtraFiles. A nil entry marks a descriptor closed.
+	fds map[int]*os.File
+	// ctl and job belong to the shell process the command runs in rather
+	// than to its streams, but travel with them to every command.
+	ctl *control
+	job *job
+}
+
+// shellFds are the descriptors above 2 that exec has opened for the shell
+// itself, and which every command inherits.
+var shellFds = map[int]*os.File{}
+
+func shellStdio() stdio {
+	return stdio{os.Stdin, os.Stdout, os.Stderr, shellFds, mainControl, nil}
+}
+
+func (std stdio) file(fd int) (*os.File, bool) {
+	switch fd {
+	case 0:
+		return std.in, std.in != nil
+	case 1:
+		return std.out, std.out != nil
+	case 2:
+		return std.err, std.err != nil
+	}
+	file, ok := std.fds[fd]
+	if !ok {
+		file = coprocFds[fd]
+	}
+	return file, file != nil
+}
+
+func (std stdio) with(fd int, file *os.File) stdio {
+	switch fd {
+	case 0:
+		std.in = file
+	case 1:
+		std.out = file
+	case 2:
+		std.err = file
+	default:
+		fds := make(map[int]*os.File, len(std.fds)+1)
+		for n, f := range std.fds {
+			fds[n] = f
+		}
+		fds[fd] = file
+		std.fds = fds
+	}
+	return std
+}
+
+// extraFiles lays out the descriptors above 2 as exec.Cmd.ExtraFiles
+// expects, with fd 3 first.
+func (std stdio) extraFiles() (files []*os.File) {
+	for fd, file := range std.fds {
+		if file == nil {
+			continue
+		}
+		for len(files) <= fd-3 {
+			files = append(files, nil)
+		}
+		files[fd-3] = file
+	}
+	return
+}
+
+var functions = map[string]*funcDef{}
+
+// control is set by exit, return, break and continue so that the commands
+// around them stop running until the enclosing shell, function or loop is
+// reached. Subshells, pipeline elements and background jobs would be
+// processes of their own in a forking shell, so each gets its own control
+// and an exit in them ends only them.
+type control struct {
+	exit           bool
+	funcReturn     bool
+	breakLevels    int
+	continueLevels int
+}
+
+// mainControl belongs to the shell itself.
+var mainControl = &control{}
+
+func (c *control) interrupted() bool {
+	return c.exit || c.funcReturn || c.breakLevels > 0 || c.continueLevels > 0
+}
+
+// interrupted reports whether the commands around the current one are to
+// be skipped, because of exit, return, break or continue.
+func (std stdio) interrupted() bool {
+	return std.ctl.interrupted()
+}
+
+// conditionDepth is above zero while running commands whose failure must
+// not trigger errexit: conditions, all but the last command of an && or ||
+// list, pipeline elements and negated pipelines.
+var conditionDepth int
+
+func checkErrexit(status int, std stdio) {
+	if status != 0 && shellOptions["errexit"] && conditionDepth == 0 {
+		std.ctl.exit = true
+	}
+}
+
+func inCondition(n node, std stdio) int {
+	conditionDepth++
+	defer func() { conditionDepth-- }()
+	return execNode(n, std)
+}
+
+func execNode(n node, std stdio) (status int) {
+	switch n := n.(type) {
+	case *cmdList:
+		for i, cmd := range n.cmds {
+			if n.async[i] {
+				startJob(n.texts[i], n.texts[i], std)
+				status = 0
+			} else {
+				status = execNode(cmd, std)
+			}
+			if std.ctl == mainControl {
+				runPendingTraps(std)
+			}
+			if std.interrupted() {
+				break
+			}
+		}
+	case *andOrList:
+		status = inCondition(n.first, std)
+		for i, op := range n.ops {
+			if std.interrupted() {
+				break
+			}
+			if (op == "&&") == (status == 0) {
+				if i < len(n.ops)-1 {
+					status = inCondition(n.rest[i], std)
+				} else {
+					status = execNode(n.rest[i], std)
+				}
+			}
+		}
+	case *pipeline:
+		if n.timed {
+			status = timePipeline(n, std)
+		} else {
+			status = ExecutePipes(n, std)
+		}
+		if !n.negate {
+			checkErrexit(status, std)
+		}
+	case *simpleCmd:
+		status = execSimple(n, std)
+		if pipelineDepth == 0 {
+			setArray("PIPESTATUS", arrayFromList([]string{strconv.Itoa(status)}))
+		}
+		checkErrexit(status, std)
+	case *condCmd:
+		status = execCond(n, std)
+		checkErrexit(status, std)
+	case *coproc:
+		status = startCoproc(n, std)
+	case *funcDef:
+		functions[n.name] = n
+	case *braceGroup:
+		status = withRedirects(n.redirs, std, func(std stdio) int {
+			return execNode(n.body, std)
+		})
+	case *subshell:
+		status = withRedirects(n.redirs, std, func(std stdio) int {
+			return runSubshell(n.body, std)
+		})
+		checkErrexit(status, std)
+	case *ifClause:
+		status = withRedirects(n.redirs, std, func(std stdio) int {
+			for i, cond := range n.conds {
+				if inCondition(cond, std) == 0 {
+					if std.interrupted() {
+						return lastStatus
+					}
+					return execNode(n.bodies[i], std)
+				}
+				if std.interrupted() {
+					return lastStatus
+				}
+			}
+			if n.elseBody != nil {
+				return execNode(n.elseBody, std)
+			}
+			return 0
+		})
+	case *loopClause:
+		status = withRedirects(n.redirs, std, func(std stdio) (status int) {
+			for {
+				if (inCondition(n.cond, std) == 0) == n.until || std.interrupted() {
+					return
+				}
+				status = execNode(n.body, std)
+				if loopFinished(std) {
+					return
+				}
+			}
+		})
+	case *forClause:
+		status = withRedirects(n.redirs, std, func(std stdio) (status int) {
+			items := positionalParams.list()
+			if n.hasIn {
+				items = expandWords(n.items)
+				if expansionFailed {
+					return expansionError(std)
+				}
+			}
+			for _, item := range items {
+				setVar(n.name, item)
+				status = execNode(n.body, std)
+				if loopFinished(std) {
+					return
+				}
+			}
+			return
+		})
+	}
+	lastStatus = status
+	return
+}
+
+// expansionError ends a command whose expansion has failed, such as on an
+// unset variable under nounset. A shell that is not interactive exits as
+// well, as POSIX requires.
+func expansionError(std stdio) int {
+	expansionFailed = false
+	if !interactive {
+		std.ctl.exit = true
+	}
+	return 1
+}
+
+// loopFinished handles a pending break or continue at the end of a loop
+// iteration and reports whether the loop should stop.
+func loopFinished(std stdio) bool {
+	ctl := std.ctl
+	if ctl.breakLevels > 0 {
+		ctl.breakLevels--
+		return true
+	}
+	if ctl.continueLevels > 0 {
+		ctl.continueLevels--
+		return ctl.continueLevels > 0
+	}
+	return ctl.exit || ctl.funcReturn
+}
+
+// runSubshell runs body with the working directory, environment, positional
+// parameters, functions, aliases and options put back afterwards, as if it
+// ran in a child.
+func runSubshell(body node, std stdio) int {
+	cwd, _ := os.Getwd()
+	env := os.Environ()
+	params := positionalParams.clone()
+	savedDirs := slices.Clone(dirStack)
+	mask := currentUmask()
+	savedArrays := snapshotArrays()
+	savedFunctions := maps.Clone(functions)
+	savedAliases := maps.Clone(aliases)
+	savedOptions, savedShopt := maps.Clone(shellOptions), maps.Clone(shoptOptions)
+
+	std.ctl = &control{}
+	status := execNode(body, std)
+
+	os.Chdir(cwd)
+	os.Clearenv()
+	for _, kv := range env {
+		for i := 0; i < len(kv); i++ {
+			if kv[i] == '=' {
+				os.Setenv(kv[:i], kv[i+1:])
+				break
+			}
+		}
+	}
+	positionalParams = params
+	dirStack = savedDirs
+	unix.Umask(mask)
+	restoreArrays(savedArrays)
+	functions = savedFunctions
+	aliases = savedAliases
+	shellOptions, shoptOptions = savedOptions, savedShopt
+	return status
+}
+
+func callFunction(body node, command []string, std stdio) int {
+	params := positionalParams
+	positionalParams = arrayFromList(command[1:])
+	callers := getArray("FUNCNAME")
+	funcNames := []string{command[0]}
+	if callers != nil {
+		funcNames = append(funcNames, callers.list()...)
+	}
+	setArray("FUNCNAME", arrayFromList(funcNames))
+
+	status := execNode(body, std)
+
+	positionalParams = params
+	setArray("FUNCNAME", callers)
+	if std.ctl.funcReturn {
+		std.ctl.funcReturn = false
+		status = lastStatus
+	}
+	return status
+}
+
+func execSimple(c *simpleCmd, std stdio) int {
+	args := c.args
+	var declared []word
+	if len(args) > 0 && isDeclarationUtility(args[0]) {
+		args = []word{args[0]}
+		for _, w := range c.args[1:] {
+			if isAssignment(w) {
+				declared = append(declared, w)
+			} else {
+				args = append(args, w)
+			}
+		}
+	}
+	command := expandWords(args)
+	if len(command) == 1 && command[0] == "exec" {
+		return execRedirects(c.redirs)
+	}
+	assigns := expandAssignments(c.assigns)
+	declaredAssigns := expandAssignments(declared)
+	if expansionFailed {
+		return expansionError(std)
+	}
+	if shellOptions["xtrace"] {
+		xtrace(assigns, command, declaredAssigns)
+	}
+
+	return withRedirects(c.redirs, std, func(std stdio) int {
+		if len(command) == 0 {
+			applyAssignments(assigns)
+			return lastStatus
+		}
+		defer applyAssignments(assigns)()
+		if len(declaredAssigns) > 0 {
+			lastStatus = Declare(command, declaredAssigns, std.streams())
+			return lastStatus
+		}
+		return runCommand(command, std)
+	})
+}
+
+// withRedirects opens the files named by redirs and runs fn with them in
+// place of the descriptors they redirect.
+func withRedirects(redirs []redirect, std stdio, fn func(stdio) int) int {
+	std, opened, ok := openRedirects(redirs, std)
+	defer func() {
+		for _, file := range opened {
+			file.Close()
+		}
+	}()
+	if !ok {
+		return 1
+	}
+	return fn(std)
+}
+
+func openRedirects(redirs []redirect, std stdio) (stdio, []*os.File, bool) {
+	var opened []*os.File
+	for _, r := range redirs {
+		target := expandString(r.target)
+		fd := r.fd
+		if fd == -1 {
+			fd = 1
+			if r.op[0] == '<' {
+				fd = 0
+			}
+		}
+
+		var file *os.File
+		var err error
+		switch r.op {
+		case ">", "&>":
+			if shellOptions["noclobber"] {
+				if info, statErr := os.Stat(target); statErr == nil && info.Mode().IsRegular() {
+					fmt.Fprintf(std.err, "gosh: %s: cannot overwrite existing file\n", target)
+					return std, opened, false
+				}
+				file, err = os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+				if os.IsExist(err) {
+					file, err = os.OpenFile(target, os.O_WRONLY, 0644)
+				}
+				break
+			}
+			file, err = os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		case ">|":
+			file, err = os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		case ">>", "&>>":
+			file, err = os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		case "<":
+			file, err = os.Open(target)
+		case "<>":
+			file, err = os.OpenFile(target, os.O_RDWR|os.O_CREATE, 0644)
+		case ">&", "<&":
+			if target == "-" {
+				std = std.with(fd, nil)
+				continue
+			}
+			src, convErr := strconv.Atoi(target)
+			srcFile, open := std.file(src)
+			if convErr != nil || !open {
+				fmt.Fprintf(std.err, "gosh: %s: bad file descriptor\n", target)
+				return std, opened, false
+			}
+			std = std.with(fd, srcFile)
+			continue
+		}
+		if err != nil {
+			fmt.Fprintf(std.err, "gosh: %s: %s\n", target, errorText(unwrapPathError(err)))
+			return std, opened, false
+		}
+		opened = append(opened, file)
+		std = std.with(fd, file)
+		if r.op == "&>" || r.op == "&>>" {
+			std = std.with(2, file)
+		}
+	}
+	return std, opened, true
+}
+
+// execRedirects applies the redirections of an exec without a command to
+// the shell itself. Descriptors 0 to 2 are replaced with dup2 so that
+// everything the shell prints follows them; higher ones are kept in
+// shellFds, since the Go runtime may be using those numbers itself.
+func execRedirects(redirs []redirect) int {
+	std, opened, ok := openRedirects(redirs, shellStdio())
+	defer func() {
+		for _, file := range opened {
+			if !slices.Contains(slices.Collect(maps.Values(shellFds)), file) {
+				file.Close()
+			}
+		}
+	}()
+	if !ok {
+		return 1
+	}
+
+	fds := make(map[int]*os.File, len(std.fds))
+	for fd, file := range std.fds {
+		if file == nil {
+			closeCoprocFd(fd)
+			continue
+		}
+		if file == os.Stdin || file == os.Stdout || file == os.Stderr {
+			dup, err := unix.FcntlInt(file.Fd(), unix.F_DUPFD_CLOEXEC, 10)
+			if err != nil {
+				fmt.Fprintf(std.err, "gosh: %d: %s\n", fd, err)
+				return 1
+			}
+			file = os.NewFile(uintptr(dup), file.Name())
+		}
+		fds[fd] = file
+	}
+	for _, old := range shellFds {
+		if !slices.Contains(slices.Collect(maps.Values(fds)), old) && !isCoprocFile(old) {
+			old.Close()
+		}
+	}
+	// The table is changed in place, since the list or function that ran
+	// exec goes on using it for the commands after.
+	clear(shellFds)
+	maps.Copy(shellFds, fds)
+
+	for fd, file := range []*os.File{std.in, std.out, std.err} {
+		var err error
+		if file == nil {
+			err = unix.Close(fd)
+		} else if int(file.Fd()) != fd {
+			err = unix.Dup2(int(file.Fd()), fd)
+		}
+		if err != nil {
+			fmt.Fprintf(std.err, "gosh: %d: %s\n", fd, err)
+			return 1
+		}
+	}
+	return 0
+}
+
+// execCommand replaces gosh with command, once the history has been saved
+// and the command's descriptors moved into place.
+func execCommand(command []string, std stdio) int {
+	path := command[0]
+	if !strings.Contains(path, "/") {
+		found, fullPath := findExec(path)
+		if !found {
+			fmt.Fprintf(std.err, "gosh: exec: %s: not found\n", path)
+			return 127
+		}
+		path = fullPath
+	}
+
+	saveToHistory()
+	currHistoryInit += len(currHistory)
+	currHistory = currHistory[:0]
+
+	for fd, file := range []*os.File{std.in, std.out, std.err} {
+		if file == nil {
+			unix.Close(fd)
+		} else if int(file.Fd()) != fd {
+			unix.Dup2(int(file.Fd()), fd)
+		}
+	}
+	for fd, file := range std.fds {
+		if file != nil {
+			unix.Dup2(int(file.Fd()), fd)
+		}
+	}
+	err := unix.Exec(path, command, os.Environ())
+	fmt.Fprintf(std.err, "gosh: exec: %s: %s\n", command[0], errorText(err))
+	return 126
+}
+
+func Eval(command []string, std streams) int {
+	source := strings.Join(command[1:], " ")
+	cmd, err := parse(source)
+	if err != nil {
+		fmt.Fprintf(std.err, "gosh: eval: %s\n", asSyntaxError(err, source, 1))
+		return 2
+	}
+	return execNode(cmd, std.files)
+}
+
+// pipelineDepth counts the pipelines being run, so that only the outermost
+// one sets PIPESTATUS.
+var pipelineDepth int
+
+// ExecutePipes runs the commands of a pipeline at the same time. When
+// there is more than one, each runs in a subshell, as a new gosh process,
+// so that nothing they change reaches the shell, which only waits for
+// them.
+func ExecutePipes(p *pipeline, std stdio) int {
+	statuses := make([]int, len(p.cmds))
+	conditionDepth++
+	pipelineDepth++
+	defer func() { conditionDepth-- }()
+
+	if len(p.cmds) == 1 {
+		statuses[0] = execNode(p.cmds[0], std)
+	} else {
+		waits := make([]func() int, 0, len(p.cmds))
+		in := std.in
+		for idx, text := range p.texts {
+			stageStdio := std
+			stageStdio.in = in
+			var next *os.File
+			if idx < len(p.texts)-1 {
+				r, w, err := os.Pipe()
+				if err != nil {
+					// Let the commands already started finish reading
+					// before giving up on the rest of the pipeline.
+					fmt.Fprintf(std.err, "gosh: pipe: %s\n", errorText(err))
+					if in != std.in {
+						in.Close()
+					}
+					for _, wait := range waits {
+						wait()
+					}
+					pipelineDepth--
+					return 1
+				}
+				stageStdio.out, next = w, r
+			}
+			waits = append(waits, startSubshell(text, stageStdio))
+			if stageStdio.out != std.out {
+				stageStdio.out.Close()
+			}
+			if in != std.in {
+				in.Close()
+			}
+			in = next
+		}
+		for idx, wait := range waits {
+			statuses[idx] = wait()
+		}
+	}
+	pipelineDepth--
+
+	if pipelineDepth == 0 {
+		pipeStatus := newArray(false)
+		for _, s := range statuses {
+			pipeStatus.appendValues(strconv.Itoa(s))
+		}
+		setArray("PIPESTATUS", pipeStatus)
+	}
+	status := statuses[len(statuses)-1]
+	if shellOptions["pipefail"] {
+		for _, s := range statuses {
+			if s != 0 {
+				status = s
+			}
+		}
+	}
+	if p.negate {
+		if status == 0 {
+			status = 1
+		} else {
+			status = 0
+		}
+	}
+	return status
+}
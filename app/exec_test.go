@@ -0,0 +1,13 @@
+package main
+
+import "testing"
+
+func TestExecRedirectSeenOnSameLine(t *testing.T) {
+	stdout, stderr, _ := runGosh(t, `exec 3>out.txt; echo x >&3; exec 3>&-
+f() { exec 4>>out.txt; echo y >&4; }; f
+cat out.txt
+`)
+	if want := "x\ny\n"; stdout != want || stderr != "" {
+		t.Errorf("got %q, %q; want %q", stdout, stderr, want)
+	}
+}
@@ -0,0 +1,656 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// fieldBuilder collects the fields a word expands to. Alongside the literal
+// text of the current field it keeps a glob pattern in which quoted
+// metacharacters are escaped, so pathname expansion can tell them apart.
+type fieldBuilder struct {
+	fields   []string
+	patterns []string
+	cur      strings.Builder
+	pat      strings.Builder
+	curHas   bool
+	hasGlob  bool
+	globs    []bool
+	ifs      string
+}
+
+func newFieldBuilder() *fieldBuilder {
+	ifs, set := os.LookupEnv("IFS")
+	if !set {
+		ifs = " \t\n"
+	}
+	return &fieldBuilder{ifs: ifs}
+}
+
+func (fb *fieldBuilder) flush(force bool) {
+	if !fb.curHas && !force {
+		return
+	}
+	fb.fields = append(fb.fields, fb.cur.String())
+	fb.patterns = append(fb.patterns, fb.pat.String())
+	fb.globs = append(fb.globs, fb.hasGlob)
+	fb.cur.Reset()
+	fb.pat.Reset()
+	fb.curHas = false
+	fb.hasGlob = false
+}
+
+func (fb *fieldBuilder) addByte(c byte, quoted bool) {
+	fb.cur.WriteByte(c)
+	if c == '*' || c == '?' || c == '[' || c == '\\' || c == ']' {
+		if quoted {
+			fb.pat.WriteByte('\\')
+		} else if c != '\\' && c != ']' {
+			fb.hasGlob = true
+		}
+	}
+	fb.pat.WriteByte(c)
+	fb.curHas = true
+}
+
+// addText appends text to the current field without splitting it.
+func (fb *fieldBuilder) addText(text string, quoted bool) {
+	for i := 0; i < len(text); i++ {
+		fb.addByte(text[i], quoted)
+	}
+	if quoted {
+		fb.curHas = true
+	}
+}
+
+func (fb *fieldBuilder) isIFSWhitespace(c byte) bool {
+	return (c == ' ' || c == '\t' || c == '\n') && strings.IndexByte(fb.ifs, c) != -1
+}
+
+// addSplit appends the result of an unquoted expansion, splitting it into
+// fields on IFS. Runs of IFS whitespace form one delimiter and are dropped
+// at the edges, while every other IFS character delimits a field of its own.
+func (fb *fieldBuilder) addSplit(text string) {
+	if fb.ifs == "" {
+		fb.addText(text, false)
+		return
+	}
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		if fb.isIFSWhitespace(c) {
+			fb.flush(false)
+			for i+1 < len(text) && fb.isIFSWhitespace(text[i+1]) {
+				i++
+			}
+			if i+1 < len(text) && strings.IndexByte(fb.ifs, text[i+1]) != -1 {
+				i++
+				for i+1 < len(text) && fb.isIFSWhitespace(text[i+1]) {
+					i++
+				}
+			}
+		} else if strings.IndexByte(fb.ifs, c) != -1 {
+			fb.flush(true)
+			for i+1 < len(text) && fb.isIFSWhitespace(text[i+1]) {
+				i++
+			}
+		} else {
+			fb.addByte(c, false)
+		}
+	}
+}
+
+// expansionFailed is set when an expansion reports an error, such as an
+// unset variable under nounset, so the command using it is not run.
+var expansionFailed bool
+
+func expandWords(words []word) (command []string) {
+	for _, w := range words {
+		fb := newFieldBuilder()
+		fb.expandWord(w)
+		fb.flush(false)
+		for i, field := range fb.fields {
+			if fb.globs[i] && !shellOptions["noglob"] {
+				if matches := glob(fb.patterns[i]); len(matches) > 0 {
+					command = append(command, matches...)
+					continue
+				}
+			}
+			command = append(command, field)
+		}
+	}
+	return
+}
+
+// glob returns the paths matching pattern in sorted order. As in other
+// shells, a leading '.' in a name has to be matched explicitly.
+func glob(pattern string) []string {
+	components := strings.Split(pattern, "/")
+	paths := []string{""}
+	if strings.HasPrefix(pattern, "/") {
+		paths = []string{"/"}
+		components = components[1:]
+	}
+
+	for i, component := range components {
+		last := i == len(components)-1
+		if component == "" {
+			if last {
+				continue
+			}
+			for j := range paths {
+				if !strings.HasSuffix(paths[j], "/") {
+					paths[j] += "/"
+				}
+			}
+			continue
+		}
+		var next []string
+		if !strings.ContainsAny(component, "*?[") {
+			literal := unescapeGlob(component)
+			for _, dir := range paths {
+				path := dir + literal
+				if _, err := os.Lstat(path); err == nil {
+					next = append(next, path)
+				}
+			}
+		} else {
+			for _, dir := range paths {
+				readDir := dir
+				if readDir == "" {
+					readDir = "."
+				}
+				entries, err := os.ReadDir(readDir)
+				if err != nil {
+					continue
+				}
+				for _, entry := range entries {
+					name := entry.Name()
+					if name[0] == '.' && component[0] != '.' {
+						continue
+					}
+					if !last && !entry.IsDir() && entry.Type()&os.ModeSymlink == 0 {
+						continue
+					}
+					if matched, _ := filepath.Match(component, name); matched {
+						next = append(next, dir+name)
+					}
+				}
+			}
+		}
+		if len(next) == 0 {
+			return nil
+		}
+		if !last {
+			for j := range next {
+				next[j] += "/"
+			}
+		}
+		paths = next
+	}
+	slices.Sort(paths)
+	return paths
+}
+
+func unescapeGlob(s string) string {
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		out.WriteByte(s[i])
+	}
+	return out.String()
+}
+
+// expandString expands a word without field splitting, as is done for the
+// value of an assignment.
+func expandString(w word) string {
+	fb := newFieldBuilder()
+	fb.ifs = ""
+	fb.expandWord(w)
+	fb.flush(false)
+	return strings.Join(fb.fields, " ")
+}
+
+func (fb *fieldBuilder) expandWord(w word) {
+	if len(w) > 0 && w[0].quote == 0 && strings.HasPrefix(w[0].text, "~") {
+		prefix, rest, slash := strings.Cut(w[0].text[1:], "/")
+		if slash || len(w) == 1 {
+			if dir, ok := expandTilde(prefix); ok {
+				fb.addText(dir, true)
+				if slash {
+					rest = "/" + rest
+				}
+				w = append(word{{rest, 0}}, w[1:]...)
+			}
+		}
+	}
+	for _, part := range w {
+		switch part.quote {
+		case '\'', '\\':
+			fb.addText(part.text, true)
+		case '"':
+			if !isListExpansion(part.text) {
+				fb.curHas = true
+			}
+			fb.expandText(part.text, true)
+		default:
+			fb.expandText(part.text, false)
+		}
+	}
+}
+
+// expandTilde returns the directory a ~prefix at the start of a word
+// stands for: a home directory, PWD, OLDPWD or an entry of the directory
+// stack.
+func expandTilde(prefix string) (string, bool) {
+	switch prefix {
+	case "":
+		if home, set := os.LookupEnv("HOME"); set {
+			return home, true
+		}
+		if u, err := user.Current(); err == nil {
+			return u.HomeDir, true
+		}
+		return "", false
+	case "+":
+		return os.LookupEnv("PWD")
+	case "-":
+		return os.LookupEnv("OLDPWD")
+	}
+	if dir, ok := tildeDir(prefix); ok {
+		return dir, true
+	}
+	if u, err := user.Lookup(prefix); err == nil {
+		return u.HomeDir, true
+	}
+	return "", false
+}
+
+func (fb *fieldBuilder) expandText(text string, quoted bool) {
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		if c == '`' {
+			end := matchBacktick(text, i)
+			fb.addExpansion(commandSubstitution(unescapeBackticks(text[i+1:end])), quoted)
+			i = end
+			continue
+		}
+		if c != '$' || i+1 >= len(text) {
+			fb.addByte(c, quoted)
+			continue
+		}
+
+		next := text[i+1]
+		switch {
+		case next == '(':
+			end := matchParen(text, i+1)
+			fb.addExpansion(commandSubstitution(text[i+2:end]), quoted)
+			i = end
+		case next == '{':
+			end := matchBrace(text, i+1)
+			if end == -1 {
+				fb.addByte(c, quoted)
+				continue
+			}
+			fb.expandBraced(text[i+2:end], quoted)
+			i = end
+		case next == '@' || next == '*' || next == '#' || next == '?' || next == '$' || next == '!' || next == '-' || (next >= '0' && next <= '9'):
+			fb.expandParam(text[i+1:i+2], quoted)
+			i++
+		case next == '_' || (next >= 'a' && next <= 'z') || (next >= 'A' && next <= 'Z'):
+			j := i + 1
+			for j < len(text) && isValidName(text[i+1:j+1]) {
+				j++
+			}
+			fb.expandParam(text[i+1:j], quoted)
+			i = j - 1
+		default:
+			fb.addByte(c, quoted)
+		}
+	}
+}
+
+func (fb *fieldBuilder) addExpansion(value string, quoted bool) {
+	if quoted {
+		fb.addText(value, true)
+	} else {
+		fb.addSplit(value)
+	}
+}
+
+func (fb *fieldBuilder) expandParam(name string, quoted bool) {
+	if name == "@" || name == "*" {
+		fb.addList(positionalParams.list(), name == "*", quoted)
+		return
+	}
+	value, set := lookupParam(name)
+	if !set && shellOptions["nounset"] {
+		fb.unboundVariable(name)
+	}
+	fb.addExpansion(value, quoted)
+}
+
+func (fb *fieldBuilder) unboundVariable(name string) {
+	fmt.Fprintf(os.Stderr, "gosh: %s: unbound variable\n", name)
+	expansionFailed = true
+}
+
+// addList adds the values of $@, $* or an array. Unless joined by a quoted
+// "$*", each value becomes a field of its own.
+func (fb *fieldBuilder) addList(values []string, star bool, quoted bool) {
+	if star && quoted {
+		sep := ""
+		if fb.ifs != "" {
+			sep = fb.ifs[:1]
+		} else if _, set := os.LookupEnv("IFS"); !set {
+			sep = " "
+		}
+		fb.addText(strings.Join(values, sep), true)
+		return
+	}
+	for i, value := range values {
+		if i > 0 {
+			fb.flush(quoted)
+		}
+		fb.addExpansion(value, quoted)
+	}
+}
+
+// expandBraced expands the inside of a ${...}: a parameter with an optional
+// [subscript], an optional :offset:length slice, and a leading # for the
+// length or ! for the keys of an array or an indirect reference.
+func (fb *fieldBuilder) expandBraced(inner string, quoted bool) {
+	if inner == "#" || inner == "!" {
+		fb.expandParam(inner, quoted)
+		return
+	}
+	length, keys := false, false
+	if len(inner) > 1 && inner[0] == '#' {
+		length, inner = true, inner[1:]
+	} else if len(inner) > 1 && inner[0] == '!' {
+		keys, inner = true, inner[1:]
+	}
+
+	i := 0
+	switch {
+	case inner != "" && strings.IndexByte("@*#?$!-", inner[0]) != -1:
+		i = 1
+	case inner != "" && inner[0] >= '0' && inner[0] <= '9':
+		for i < len(inner) && inner[i] >= '0' && inner[i] <= '9' {
+			i++
+		}
+	default:
+		for i < len(inner) && isValidName(inner[:i+1]) {
+			i++
+		}
+	}
+	name, rest := inner[:i], inner[i:]
+	subscript, hasSubscript := "", false
+	if strings.HasPrefix(rest, "[") {
+		end := strings.IndexByte(rest, ']')
+		if end == -1 {
+			name = ""
+		} else {
+			subscript, rest, hasSubscript = rest[1:end], rest[end+1:], true
+		}
+	}
+	sliceSpec, hasSlice := "", false
+	if strings.HasPrefix(rest, ":") {
+		sliceSpec, rest, hasSlice = rest[1:], "", true
+	}
+	if name == "" || rest != "" {
+		fmt.Fprintf(os.Stderr, "gosh: ${%s}: bad substitution\n", inner)
+		expansionFailed = true
+		return
+	}
+
+	var values []string
+	var value string
+	isList, star := false, false
+	switch {
+	case hasSubscript && (subscript == "@" || subscript == "*"):
+		isList, star = true, subscript == "*"
+		if a := getArray(name); a != nil {
+			if keys {
+				values = a.indices()
+			} else {
+				values = a.list()
+			}
+		} else if v, set := lookupParam(name); set {
+			values = []string{v}
+			if keys {
+				values = []string{"0"}
+			}
+		}
+	case (name == "@" || name == "*") && !hasSubscript:
+		isList, star = true, name == "*"
+		values = positionalParams.list()
+		if hasSlice {
+			values = append([]string{shellName}, values...)
+		}
+	case keys:
+		target, _ := lookupParam(name)
+		if !isValidName(target) && !isDigits(target) {
+			fmt.Fprintf(os.Stderr, "gosh: %s: invalid indirect expansion\n", name)
+			expansionFailed = true
+			return
+		}
+		value, _ = lookupParam(target)
+	case hasSubscript:
+		set := false
+		if a := getArray(name); a != nil {
+			if key, ok := a.resolveKey(expandString(word{{subscript, '"'}})); ok {
+				value, set = a.get(key)
+			}
+		} else if n, ok := evalIndex(expandString(word{{subscript, '"'}})); ok && (n == 0 || n == -1) {
+			value, set = lookupParam(name)
+		}
+		if !set && shellOptions["nounset"] {
+			fb.unboundVariable(name + "[" + subscript + "]")
+		}
+	default:
+		var set bool
+		value, set = lookupParam(name)
+		if !set && shellOptions["nounset"] {
+			fb.unboundVariable(name)
+		}
+	}
+
+	if hasSlice {
+		offsetSpec, lengthSpec, hasLength := strings.Cut(sliceSpec, ":")
+		offset, ok := evalIndex(expandString(word{{offsetSpec, '"'}}))
+		count := 0
+		if hasLength && ok {
+			count, ok = evalIndex(expandString(word{{lengthSpec, '"'}}))
+		}
+		if !ok {
+			fmt.Fprintf(os.Stderr, "gosh: %s: bad substitution\n", sliceSpec)
+			expansionFailed = true
+			return
+		}
+		if isList {
+			values = sliceOf(values, offset, count, hasLength)
+		} else {
+			value = string(sliceOf([]rune(value), offset, count, hasLength))
+		}
+	}
+
+	switch {
+	case length && isList:
+		fb.addExpansion(strconv.Itoa(len(values)), quoted)
+	case length:
+		fb.addExpansion(strconv.Itoa(len([]rune(value))), quoted)
+	case isList:
+		fb.addList(values, star, quoted)
+	default:
+		fb.addExpansion(value, quoted)
+	}
+}
+
+// sliceOf implements ${name:offset:length}, where negative values count back
+// from the end.
+func sliceOf[T any](values []T, offset int, length int, hasLength bool) []T {
+	if offset < 0 {
+		offset = max(0, len(values)+offset)
+	}
+	if offset > len(values) {
+		return nil
+	}
+	end := len(values)
+	if hasLength {
+		if length < 0 {
+			end = len(values) + length
+		} else {
+			end = min(len(values), offset+length)
+		}
+	}
+	if end < offset {
+		return nil
+	}
+	return values[offset:end]
+}
+
+func lookupParam(name string) (string, bool) {
+	switch name {
+	case "?":
+		return strconv.Itoa(lastStatus), true
+	case "$":
+		return strconv.Itoa(shellPid), true
+	case "#":
+		return strconv.Itoa(positionalParams.len()), true
+	case "0":
+		return shellName, true
+	case "-":
+		return optionFlags(), true
+	case "!":
+		if lastPid == 0 {
+			return "", false
+		}
+		return strconv.Itoa(lastPid), true
+	case "@", "*":
+		return strings.Join(positionalParams.list(), " "), positionalParams.len() > 0
+	}
+	if n, err := strconv.Atoi(name); err == nil {
+		return positionalParams.get(strconv.Itoa(n - 1))
+	}
+	return lookupVar(name)
+}
+
+// matchBrace returns the index of the brace closing the ${ whose '{' is at
+// text[open], or -1 if it is never closed.
+func matchBrace(text string, open int) int {
+	depth := 0
+	for i := open; i < len(text); i++ {
+		switch text[i] {
+		case '\\':
+			i++
+		case '\'':
+			if depth > 1 {
+				continue
+			}
+			if end := strings.IndexByte(text[i+1:], '\''); end != -1 {
+				i += end + 1
+			}
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// isListExpansion reports whether a double quoted part is just "$@" or a
+// "${name[@]}", which yield no field at all when there is nothing to list.
+func isListExpansion(text string) bool {
+	if text == "$@" {
+		return true
+	}
+	return strings.HasPrefix(text, "${") && matchBrace(text, 1) == len(text)-1 && (text[2] == '@' || strings.Contains(text, "[@]"))
+}
+
+// matchParen returns the index of the parenthesis closing the one at
+// text[open], skipping over quoted text.
+func matchParen(text string, open int) int {
+	depth := 0
+	for i := open; i < len(text); i++ {
+		switch text[i] {
+		case '\\':
+			i++
+		case '\'':
+			if end := strings.IndexByte(text[i+1:], '\''); end != -1 {
+				i += end + 1
+			} else {
+				return len(text) - 1
+			}
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return len(text) - 1
+}
+
+func matchBacktick(text string, open int) int {
+	for i := open + 1; i < len(text); i++ {
+		if text[i] == '\\' {
+			i++
+		} else if text[i] == '`' {
+			return i
+		}
+	}
+	return len(text) - 1
+}
+
+func unescapeBackticks(text string) string {
+	text = strings.TrimSuffix(text, "`")
+	var out strings.Builder
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\\' && i+1 < len(text) && strings.IndexByte("$`\\", text[i+1]) != -1 {
+			i++
+		}
+		out.WriteByte(text[i])
+	}
+	return out.String()
+}
+
+// commandSubstitution runs src in a subshell with its stdout connected to
+// a pipe and returns what it printed, minus trailing newlines.
+func commandSubstitution(src string) string {
+	cmd, err := parse(src)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gosh: command substitution: %s\n", asSyntaxError(err, src, 1))
+		lastStatus = 2
+		return ""
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return ""
+	}
+	done := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		done <- string(data)
+	}()
+
+	lastStatus = runSubshell(cmd, shellStdio().with(1, w))
+	w.Close()
+
+	output := <-done
+	r.Close()
+	return strings.TrimRight(output, "\n")
+}
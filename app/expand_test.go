@@ -0,0 +1,14 @@
+package main
+
+import "testing"
+
+func TestCommandSubstitutionDoesNotChangeShell(t *testing.T) {
+	stdout, _, _ := runGosh(t, `cd /tmp
+y=1
+a=$(cd /; y=5; set -u; echo "$PWD")
+echo "$a $PWD $y [$-]"
+`)
+	if want := "/ /tmp 1 []\n"; stdout != want {
+		t.Errorf("got %q, want %q", stdout, want)
+	}
+}
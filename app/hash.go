@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// hashEntry is a remembered PATH lookup and the number of times it has
+// been used since.
+type hashEntry struct {
+	path string
+	hits int
+}
+
+// hashTable caches where commands were found on PATH. It is dropped
+// whenever PATH no longer holds the value it was filled from.
+var (
+	hashTable = map[string]*hashEntry{}
+	hashPath  string
+	hashMu    sync.Mutex
+)
+
+// checkHashPath empties the table if PATH has been assigned since it was
+// last used. hashMu must be held.
+func checkHashPath() {
+	if path := os.Getenv("PATH"); path != hashPath {
+		clear(hashTable)
+		hashPath = path
+	}
+}
+
+// resetHash forgets every remembered command, as assigning PATH does.
+func resetHash() {
+	hashMu.Lock()
+	defer hashMu.Unlock()
+	clear(hashTable)
+	hashPath = os.Getenv("PATH")
+}
+
+// lookupCommand resolves program to the file that would run for it,
+// through the hash table when it is there, remembering it when not.
+func lookupCommand(program string) (string, bool) {
+	if strings.Contains(program, "/") {
+		return program, isExecutable(program)
+	}
+	hashMu.Lock()
+	defer hashMu.Unlock()
+	checkHashPath()
+	if entry, ok := hashTable[program]; ok {
+		if isExecutable(entry.path) {
+			entry.hits++
+			return entry.path, true
+		}
+		delete(hashTable, program)
+	}
+	found, fullPath := findExec(program)
+	if !found {
+		return "", false
+	}
+	hashTable[program] = &hashEntry{fullPath, 1}
+	return fullPath, true
+}
+
+// hashedPath returns the path remembered for program, if any, without
+// searching PATH.
+func hashedPath(program string) (string, bool) {
+	hashMu.Lock()
+	defer hashMu.Unlock()
+	checkHashPath()
+	if entry, ok := hashTable[program]; ok {
+		return entry.path, true
+	}
+	return "", false
+}
+
+// isExecutable reports whether gosh itself may execute the file at path,
+// which depends on whether it is the owner or in the group.
+func isExecutable(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir() && unix.Access(path, unix.X_OK) == nil
+}
+
+func Hash(command []string, std streams) int {
+	hashMu.Lock()
+	defer hashMu.Unlock()
+	checkHashPath()
+
+	args := command[1:]
+	var reset, remove, show bool
+	path := ""
+	for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+		arg := args[0]
+		args = args[1:]
+		if arg == "--" {
+			break
+		}
+		for _, flag := range arg[1:] {
+			switch flag {
+			case 'r':
+				reset = true
+			case 'd':
+				remove = true
+			case 't':
+				show = true
+			case 'p':
+				if len(args) == 0 {
+					fmt.Fprintln(std.err, "hash: -p: option requires an argument")
+					return 2
+				}
+				path = args[0]
+				args = args[1:]
+			default:
+				fmt.Fprintf(std.err, "hash: -%c: invalid option\n", flag)
+				fmt.Fprintln(std.err, "hash: usage: hash [-r] [-p pathname] [-dt] [name ...]")
+				return 2
+			}
+		}
+	}
+
+	if reset {
+		clear(hashTable)
+	}
+	if len(args) == 0 {
+		if reset || path != "" || remove {
+			return 0
+		}
+		if len(hashTable) == 0 {
+			if !show {
+				return std.print("hash", "hash: hash table empty\n")
+			}
+			return 0
+		}
+		names := make([]string, 0, len(hashTable))
+		for name := range hashTable {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		var output strings.Builder
+		output.WriteString("hits\tcommand\n")
+		for _, name := range names {
+			fmt.Fprintf(&output, "%4d\t%s\n", hashTable[name].hits, hashTable[name].path)
+		}
+		return std.print("hash", output.String())
+	}
+
+	var output strings.Builder
+	status := 0
+	for _, name := range args {
+		switch {
+		case path != "":
+			hashTable[name] = &hashEntry{path, 0}
+		case remove:
+			if _, ok := hashTable[name]; !ok {
+				fmt.Fprintf(std.err, "gosh: hash: %s: not found\n", name)
+				status = 1
+			}
+			delete(hashTable, name)
+		case show:
+			entry, ok := hashTable[name]
+			if !ok {
+				fmt.Fprintf(std.err, "gosh: hash: %s: not found\n", name)
+				status = 1
+			} else if len(args) > 1 {
+				fmt.Fprintf(&output, "%s\t%s\n", name, entry.path)
+			} else {
+				output.WriteString(entry.path + "\n")
+			}
+		case builtins[name] != nil || strings.Contains(name, "/"):
+		default:
+			found, fullPath := findExec(name)
+			if !found {
+				fmt.Fprintf(std.err, "gosh: hash: %s: not found\n", name)
+				status = 1
+				continue
+			}
+			hashTable[name] = &hashEntry{fullPath, 0}
+		}
+	}
+	if std.print("hash", output.String()) != 0 {
+		return 1
+	}
+	return status
+}
+
+// Command runs a builtin or an external command while passing over any
+// function of the same name, or with -v and -V describes what would run.
+func Command(command []string, std streams) int {
+	args := command[1:]
+	describe, verbose := false, false
+	for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+		arg := args[0]
+		args = args[1:]
+		if arg == "--" {
+			break
+		}
+		for _, flag := range arg[1:] {
+			switch flag {
+			case 'v':
+				describe = true
+			case 'V':
+				describe, verbose = true, true
+			case 'p':
+			default:
+				fmt.Fprintf(std.err, "gosh: command: -%c: invalid option\n", flag)
+				fmt.Fprintln(std.err, "command: usage: command [-pVv] command [arg ...]")
+				return 2
+			}
+		}
+	}
+	if len(args) == 0 {
+		return 0
+	}
+	if !describe {
+		return runUtility(args, std.files)
+	}
+
+	status := 0
+	for _, name := range args {
+		var description string
+		switch {
+		case verbose:
+			if lines, found := describeCommand(name, typeFlags{}); found {
+				description = lines[0] + "\n"
+			} else {
+				fmt.Fprintf(std.err, "gosh: command: %s: not found\n", name)
+			}
+		case aliases[name] != "":
+			description = aliasDefinition(name)
+		case functions[name] != nil || builtins[name] != nil || reservedWords[name]:
+			description = name + "\n"
+		default:
+			if lines, found := describeCommand(name, typeFlags{pathOnly: true, forcePath: true}); found {
+				description = lines[0] + "\n"
+			}
+		}
+		if description == "" {
+			status = 1
+			continue
+		}
+		if std.print("command", description) != 0 {
+			return 1
+		}
+	}
+	return status
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"os"
+	"slices"
+	"syscall"
+
+	"github.com/chzyer/readline"
+	"golang.org/x/sys/unix"
+)
+
+// lineReader is the interactive shell's readline, whose history is kept
+// the same as the shell's.
+var lineReader *readline.Instance
+
+// historyFileState is where gosh has read or written the history file up
+// to, so that history -n and share_history take in only the entries other
+// sessions have added since. lastEntry finds that place again when
+// another session has rewritten the file.
+var historyFileState struct {
+	path      string
+	ino       uint64
+	offset    int64
+	lastEntry histEntry
+	unread    []histEntry
+}
+
+// lockHistory takes a lock on the history file at path, exclusive for
+// writing or shared for reading, and returns the function that releases
+// it. The lock is held on a file beside it, since rewriting the history
+// file replaces it.
+func lockHistory(path string, exclusive bool) func() {
+	if path == "" {
+		return func() {}
+	}
+	file, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return func() {}
+	}
+	how := unix.LOCK_SH
+	if exclusive {
+		how = unix.LOCK_EX
+	}
+	for unix.Flock(int(file.Fd()), how) == unix.EINTR {
+	}
+	return func() {
+		unix.Flock(int(file.Fd()), unix.LOCK_UN)
+		file.Close()
+	}
+}
+
+// markHistoryRead records that everything in the history file at path has
+// been seen, after gosh has loaded or written it. A file that is not there
+// yet has been seen up to its start. The lock must be held.
+func markHistoryRead(path string, last []histEntry) {
+	state := &historyFileState
+	state.path, state.ino, state.offset = path, 0, 0
+	if info, err := os.Stat(path); err == nil {
+		state.offset = info.Size()
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			state.ino = stat.Ino
+		}
+	}
+	if len(last) > 0 {
+		state.lastEntry = last[len(last)-1]
+	}
+}
+
+// collectNewHistory reads the entries added to the history file since it
+// was last read or written, keeping them for importHistory. The lock must
+// be held.
+func collectNewHistory(path string) {
+	state := &historyFileState
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	if state.path != path {
+		// HISTFILE has changed: what is in the new file is not news.
+		markHistoryRead(path, nil)
+		return
+	}
+	var ino uint64
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		ino = stat.Ino
+	}
+
+	var added []histEntry
+	if (ino == state.ino || state.ino == 0) && info.Size() >= state.offset {
+		file, err := os.Open(path)
+		if err != nil {
+			return
+		}
+		content := make([]byte, info.Size()-state.offset)
+		_, err = file.ReadAt(content, state.offset)
+		file.Close()
+		if err != nil {
+			return
+		}
+		added = parseHistory(string(content))
+	} else {
+		// Another session has rewritten the file: the new entries are
+		// those after the last one seen, if it is still there.
+		entries, err := readHistoryFile(path)
+		if err != nil {
+			return
+		}
+		for i := len(entries) - 1; i >= 0; i-- {
+			if entries[i] == state.lastEntry {
+				added = entries[i+1:]
+				break
+			}
+		}
+	}
+	state.unread = append(state.unread, added...)
+	markHistoryRead(path, added)
+}
+
+// importHistory adds the entries other sessions have written to the
+// history, after those already there and before the ones still to be
+// saved.
+func importHistory() {
+	state := &historyFileState
+	if len(state.unread) == 0 {
+		return
+	}
+	savedHistory = append(savedHistory, state.unread...)
+	currHistoryInit += len(state.unread)
+	if lineReader != nil {
+		lineReader.ResetHistory()
+		for _, entry := range allHistory() {
+			lineReader.SaveHistory(entry.text)
+		}
+	}
+	state.unread = nil
+	trimHistory()
+}
+
+// readNewHistory takes in the entries other sessions have added to the
+// history file, for history -n and before each prompt with share_history.
+func readNewHistory() {
+	path := getHistoryPath()
+	unlock := lockHistory(path, false)
+	collectNewHistory(path)
+	unlock()
+	importHistory()
+}
+
+// appendHistoryNow writes the session's new entries to the history file
+// as soon as they are accepted, for inc_append_history and share_history,
+// so that they are kept in order with other sessions and survive a crash.
+// With share_history the entries other sessions added first are taken in;
+// otherwise they are passed over, as history -n would after history -a.
+func appendHistoryNow() {
+	path := getHistoryPath()
+	unlock := lockHistory(path, true)
+	defer unlock()
+	if shoptOptions["share_history"] {
+		collectNewHistory(path)
+		importHistory()
+	}
+	if appendHistoryFile(path, currHistory) != nil {
+		return
+	}
+	currHistoryInit += len(currHistory)
+	savedHistory = append(savedHistory, currHistory...)
+	currHistory = make([]histEntry, 0, 500)
+}
+
+// appendHistoryFile adds entries to the end of a history file and then
+// cuts it down to HISTFILESIZE entries. The lock must be held.
+func appendHistoryFile(path string, entries []histEntry) error {
+	if path == historyFileState.path {
+		eraseHistoryFileDups(path)
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	err = writeHistory(file, entries)
+	file.Close()
+	if err != nil {
+		return err
+	}
+	truncateHistoryFile(path)
+	if path == historyFileState.path {
+		markHistoryRead(path, entries)
+	}
+	return nil
+}
+
+// eraseHistoryFileDups removes from the history file the lines erasedups
+// has erased from the history since it was last written. The lock must be
+// held.
+func eraseHistoryFileDups(path string) {
+	if len(erasedHistory) == 0 {
+		return
+	}
+	entries, err := readHistoryFile(path)
+	if err != nil {
+		return
+	}
+	kept := slices.DeleteFunc(slices.Clone(entries), func(entry histEntry) bool { return erasedHistory[entry.text] })
+	if len(kept) == len(entries) || writeHistoryFile(path, kept) == nil {
+		clear(erasedHistory)
+	}
+}
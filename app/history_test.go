@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestReadHistoryTail(t *testing.T) {
+	var stamped, legacy strings.Builder
+	for i := range 5000 {
+		fmt.Fprintf(&stamped, "#%d\necho %d\n", 1700000000+i, i)
+		if i%7 == 0 {
+			fmt.Fprintf(&stamped, "echo %d continued\n", i)
+		}
+		fmt.Fprintf(&legacy, "echo %d\n", i)
+	}
+	files := map[string]string{
+		"stamped": stamped.String(),
+		"legacy":  legacy.String(),
+		"mixed":   legacy.String() + stamped.String(),
+		"short":   "#1700000000\necho a\n",
+		"empty":   "",
+	}
+	for name, content := range files {
+		path := filepath.Join(t.TempDir(), name)
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		all := parseHistory(content)
+		for _, n := range []int{0, 1, 2, 500, 4999, 5000, 10000, 20000} {
+			entries, more, err := readHistoryTail(path, n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := all[max(0, len(all)-n):]
+			if !slices.Equal(entries, want) || more != (len(all) > n) {
+				t.Errorf("%s, %d: got %d entries, more %v; want %d, %v", name, n, len(entries), more, len(want), len(all) > n)
+			}
+		}
+	}
+}
@@ -0,0 +1,551 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// job is a command started with &. It runs in a subshell process of its
+// own, and records the processes it starts so they can be waited for and
+// signalled. The subshell leads a process group of its own, which the
+// commands it runs stay in, so that the job is signalled as a whole and
+// not with the shell.
+type job struct {
+	id      int
+	command string
+	pids    []int
+	pgid    int
+	running map[int]bool
+	nohup   bool // disown -h: kept in the table but not sent SIGHUP
+	done    bool
+	status  int
+	signal  syscall.Signal // what killed its last process, if anything
+	// stop is the signal that killed the job, which must not start any
+	// more commands. It is set from whichever goroutine runs kill.
+	stop atomic.Int32
+}
+
+// errJobKilled is returned for a process a killed job did not start.
+var errJobKilled = errors.New("job killed")
+
+var (
+	jobs    []*job
+	jobsMu  sync.Mutex
+	lastPid int // $!, the first process of the most recent job
+)
+
+// startJob starts command running in the background, in a subshell, and
+// prints its number and process id when the shell is interactive. jobs
+// shows it as text. The files given are the shell's copies of descriptors
+// the job uses, which are closed once it has them.
+func startJob(command, text string, std stdio, files ...*os.File) {
+	jobsMu.Lock()
+	id := 1
+	for _, j := range jobs {
+		id = max(id, j.id+1)
+	}
+	j := &job{id: id, command: text, running: map[int]bool{}}
+	jobs = append(jobs, j)
+	jobsMu.Unlock()
+
+	// Without job control a job can never be brought to the foreground to
+	// read the terminal, and in a process group of its own it would be
+	// stopped for trying, so it reads /dev/null instead, as POSIX has it.
+	if std.in != nil {
+		if _, err := unix.IoctlGetTermios(int(std.in.Fd()), unix.TCGETS); err == nil {
+			if devNull, err := os.Open(os.DevNull); err == nil {
+				std.in = devNull
+				files = append(files, devNull)
+			}
+		}
+	}
+
+	std.job = j
+	wait := startSubshell(command, std)
+	for _, file := range files {
+		file.Close()
+	}
+	go func() {
+		status := wait()
+		jobsMu.Lock()
+		j.done, j.status = true, status
+		jobsMu.Unlock()
+	}()
+
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	if len(j.pids) > 0 {
+		lastPid = j.pids[0]
+	}
+	if interactive {
+		if len(j.pids) > 0 {
+			fmt.Fprintf(os.Stderr, "[%d] %d\n", j.id, j.pids[0])
+		} else {
+			fmt.Fprintf(os.Stderr, "[%d]\n", j.id)
+		}
+	}
+}
+
+// startProcess starts cmd and, if std belongs to a job, records it as one
+// of the job's processes, in the job's process group. jobsMu is held while
+// the process starts so that kill either reaches it through the group or
+// keeps it from starting. It returns the command that was started, which
+// is a copy of cmd if the first attempt had to be given up.
+func (std stdio) startProcess(cmd *exec.Cmd) (*exec.Cmd, error) {
+	j := std.job
+	if j == nil {
+		return cmd, cmd.Start()
+	}
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	if j.killed() {
+		return cmd, errJobKilled
+	}
+	// Once the job's processes have all exited its group is gone, and the
+	// next process leads a new one.
+	pgid := j.pgid
+	if len(j.running) == 0 {
+		pgid = 0
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Pgid: pgid}
+	err := cmd.Start()
+	if errors.Is(err, syscall.EPERM) && pgid != 0 {
+		// The last process of the group was waited for just now, but is
+		// not yet counted out of running.
+		pgid = 0
+		cmd = &exec.Cmd{
+			Path: cmd.Path, Args: cmd.Args, Env: cmd.Env, Dir: cmd.Dir,
+			Stdin: cmd.Stdin, Stdout: cmd.Stdout, Stderr: cmd.Stderr,
+			ExtraFiles:  cmd.ExtraFiles,
+			SysProcAttr: &syscall.SysProcAttr{Setpgid: true},
+		}
+		err = cmd.Start()
+	}
+	if err != nil {
+		return cmd, err
+	}
+	pid := cmd.Process.Pid
+	if pgid == 0 {
+		j.pgid = pid
+	}
+	j.pids = append(j.pids, pid)
+	j.running[pid] = true
+	return cmd, nil
+}
+
+// killed reports whether kill has ended the job, if there is one.
+func (j *job) killed() bool {
+	return j != nil && j.stop.Load() != 0
+}
+
+// processExited records that a process of the job has been waited for,
+// and whether a signal killed it.
+func (std stdio) processExited(pid int, state *os.ProcessState) {
+	if std.job == nil {
+		return
+	}
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	delete(std.job.running, pid)
+	std.job.signal = 0
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		std.job.signal = status.Signal()
+	}
+}
+
+// jobMarker returns the marker jobs shows after a job number: + for the most
+// recent job and - for the one before. jobsMu must be held.
+func jobMarker(i int) byte {
+	switch i {
+	case len(jobs) - 1:
+		return '+'
+	case len(jobs) - 2:
+		return '-'
+	}
+	return ' '
+}
+
+func (j *job) state() string {
+	switch {
+	case !j.done:
+		return "Running"
+	case j.signal != 0:
+		return signalDescription(j.signal)
+	case j.status == 0:
+		return "Done"
+	}
+	return "Exit " + strconv.Itoa(j.status)
+}
+
+func (j *job) format(marker byte, long bool) string {
+	pid := ""
+	if long && len(j.pids) > 0 {
+		pid = strconv.Itoa(j.pids[0]) + " "
+	}
+	command := j.command
+	if !j.done {
+		command += " &"
+	}
+	return fmt.Sprintf("[%d]%c  %s%-24s%s\n", j.id, marker, pid, j.state(), command)
+}
+
+// reportJobs prints the jobs that have finished since the last prompt and
+// forgets them.
+func reportJobs() {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	remaining := jobs[:0]
+	for i, j := range jobs {
+		if j.done {
+			fmt.Fprint(os.Stderr, j.format(jobMarker(i), false))
+		} else {
+			remaining = append(remaining, j)
+		}
+	}
+	jobs = remaining
+}
+
+// exitWarning counts down the prompts for which a second exit goes
+// through after warnAboutJobs has complained about the first.
+var exitWarning int
+
+// warnAboutJobs reports whether exit should be refused because jobs are
+// still running. It refuses only once: exit straight after goes through.
+func warnAboutJobs(std streams) bool {
+	if !interactive || exitWarning > 0 {
+		return false
+	}
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	for _, j := range jobs {
+		if !j.done {
+			fmt.Fprintln(std.err, "There are running jobs.")
+			exitWarning = 2
+			return true
+		}
+	}
+	return false
+}
+
+func Jobs(command []string, std streams) int {
+	long, pidsOnly := false, false
+	for _, arg := range command[1:] {
+		switch arg {
+		case "-l":
+			long = true
+		case "-p":
+			pidsOnly = true
+		default:
+			fmt.Fprintf(std.err, "gosh: jobs: %s: invalid option\n", arg)
+			fmt.Fprintln(std.err, "jobs: usage: jobs [-lp]")
+			return 2
+		}
+	}
+
+	jobsMu.Lock()
+	var output strings.Builder
+	remaining := jobs[:0]
+	for i, j := range jobs {
+		if pidsOnly {
+			for _, pid := range j.pids {
+				fmt.Fprintln(&output, pid)
+			}
+		} else {
+			output.WriteString(j.format(jobMarker(i), long))
+		}
+		if !j.done {
+			remaining = append(remaining, j)
+		}
+	}
+	jobs = remaining
+	jobsMu.Unlock()
+	return std.print("jobs", output.String())
+}
+
+// findJob resolves a job spec: %N, %+ or %% for the current job, %- for
+// the previous one, %name for the job whose command starts with name and
+// %?text for the one whose command contains text. jobsMu must be held.
+func findJob(spec string) (*job, error) {
+	name := strings.TrimPrefix(spec, "%")
+	var found *job
+	switch {
+	case name == "" || name == "+" || name == "%":
+		if len(jobs) > 0 {
+			found = jobs[len(jobs)-1]
+		}
+	case name == "-":
+		if len(jobs) > 1 {
+			found = jobs[len(jobs)-2]
+		}
+	case isDigits(name):
+		n, _ := strconv.Atoi(name)
+		for _, j := range jobs {
+			if j.id == n {
+				found = j
+			}
+		}
+	default:
+		text, contains := strings.CutPrefix(name, "?")
+		for _, j := range jobs {
+			matches := strings.HasPrefix(j.command, text)
+			if contains {
+				matches = strings.Contains(j.command, text)
+			}
+			if !matches {
+				continue
+			}
+			if found != nil {
+				return nil, fmt.Errorf("%s: ambiguous job spec", spec)
+			}
+			found = j
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%s: no such job", spec)
+	}
+	return found, nil
+}
+
+// signalJob sends sig to the process group of a job that is still
+// running. A signal that ends a process also stops the job from starting
+// any more commands. jobsMu must be held.
+func signalJob(j *job, sig syscall.Signal) error {
+	if j.done {
+		return errors.New("job has terminated")
+	}
+	var err error
+	if len(j.running) > 0 {
+		err = unix.Kill(-j.pgid, sig)
+	}
+	switch sig {
+	case 0, syscall.SIGCONT, syscall.SIGCHLD, syscall.SIGURG, syscall.SIGWINCH:
+	default:
+		j.stop.CompareAndSwap(0, int32(sig))
+		if len(j.running) == 0 {
+			j.signal = sig
+		}
+	}
+	return err
+}
+
+// hangupJobs sends SIGHUP to the process groups of the running jobs,
+// followed by SIGCONT so that a stopped one wakes up to receive it, as the
+// shell goes away. Disowned jobs are left alone.
+func hangupJobs() {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	for _, j := range jobs {
+		if j.done || j.nohup {
+			continue
+		}
+		if len(j.running) > 0 {
+			unix.Kill(-j.pgid, syscall.SIGHUP)
+			unix.Kill(-j.pgid, syscall.SIGCONT)
+		}
+	}
+}
+
+// Disown removes jobs from the table, so that they are neither listed
+// nor sent SIGHUP when the shell exits, or with -h only exempts them from
+// SIGHUP.
+func Disown(command []string, std streams) int {
+	args := command[1:]
+	var nohup, all, running bool
+	for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+		arg := args[0]
+		args = args[1:]
+		if arg == "--" {
+			break
+		}
+		for _, flag := range arg[1:] {
+			switch flag {
+			case 'h':
+				nohup = true
+			case 'a':
+				all = true
+			case 'r':
+				running = true
+			default:
+				fmt.Fprintf(std.err, "gosh: disown: -%c: invalid option\n", flag)
+				fmt.Fprintln(std.err, "disown: usage: disown [-h] [-ar] [jobspec ... | pid ...]")
+				return 2
+			}
+		}
+	}
+
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	var selected []*job
+	status := 0
+	switch {
+	case len(args) == 0 && (all || running):
+		selected = slices.Clone(jobs)
+	case len(args) == 0:
+		j, err := findJob("%+")
+		if err != nil {
+			fmt.Fprintln(std.err, "gosh: disown: current: no such job")
+			return 1
+		}
+		selected = []*job{j}
+	}
+	for _, spec := range args {
+		var j *job
+		var err error
+		if pid, convErr := strconv.Atoi(spec); convErr == nil {
+			err = fmt.Errorf("%s: no such job", spec)
+			for _, candidate := range jobs {
+				if slices.Contains(candidate.pids, pid) {
+					j, err = candidate, nil
+				}
+			}
+		} else {
+			j, err = findJob(spec)
+		}
+		if err != nil {
+			fmt.Fprintf(std.err, "gosh: disown: %s\n", err)
+			status = 1
+			continue
+		}
+		selected = append(selected, j)
+	}
+
+	for _, j := range selected {
+		if running && j.done {
+			continue
+		}
+		if nohup {
+			j.nohup = true
+		} else {
+			jobs = slices.DeleteFunc(jobs, func(other *job) bool { return other == j })
+		}
+	}
+	return status
+}
+
+const killUsage = "kill: usage: kill [-s sigspec | -n signum | -sigspec] pid | jobspec ... or kill -l [sigspec]"
+
+// Kill sends a signal, TERM unless another is given, to processes, to
+// process groups given as negative numbers and to jobs given as %specs.
+// It is a builtin so that it still works when no more processes can be
+// started.
+func Kill(command []string, std streams) int {
+	args := command[1:]
+	if len(args) == 0 {
+		fmt.Fprintln(std.err, killUsage)
+		return 2
+	}
+	sig := syscall.SIGTERM
+	switch arg := args[0]; {
+	case arg == "-l" || arg == "-L":
+		return listSignals(args[1:], std)
+	case arg == "-s" || arg == "-n":
+		if len(args) < 2 {
+			fmt.Fprintf(std.err, "gosh: kill: %s: option requires an argument\n", arg)
+			fmt.Fprintln(std.err, killUsage)
+			return 2
+		}
+		var ok bool
+		if sig, ok = killSignal(args[1]); !ok {
+			fmt.Fprintf(std.err, "gosh: kill: %s: invalid signal specification\n", args[1])
+			return 1
+		}
+		args = args[2:]
+	case arg == "--":
+		args = args[1:]
+	case len(arg) > 1 && arg[0] == '-':
+		var ok bool
+		if sig, ok = killSignal(arg[1:]); !ok {
+			fmt.Fprintf(std.err, "gosh: kill: %s: invalid signal specification\n", arg[1:])
+			return 1
+		}
+		args = args[1:]
+	}
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		fmt.Fprintln(std.err, killUsage)
+		return 2
+	}
+
+	status := 0
+	for _, target := range args {
+		if strings.HasPrefix(target, "%") {
+			jobsMu.Lock()
+			j, err := findJob(target)
+			if err == nil {
+				if err = signalJob(j, sig); err != nil {
+					err = fmt.Errorf("%s: %s", target, errorText(err))
+				}
+			}
+			jobsMu.Unlock()
+			if err != nil {
+				fmt.Fprintf(std.err, "gosh: kill: %s\n", err)
+				status = 1
+			}
+			continue
+		}
+		pid, err := strconv.Atoi(target)
+		if err != nil {
+			fmt.Fprintf(std.err, "gosh: kill: %s: arguments must be process or job IDs\n", target)
+			status = 1
+			continue
+		}
+		if err := unix.Kill(pid, sig); err != nil {
+			fmt.Fprintf(std.err, "gosh: kill: (%d) - %s\n", pid, errorText(err))
+			status = 1
+		}
+	}
+	return status
+}
+
+// killSignal is parseSignal with 0 allowed, which checks that a process
+// exists without signalling it.
+func killSignal(spec string) (syscall.Signal, bool) {
+	if spec == "0" {
+		return 0, true
+	}
+	sig, _, ok := parseSignal(spec)
+	return sig, ok
+}
+
+// listSignals implements kill -l: with no arguments it lists every
+// signal, and otherwise it turns names into numbers and numbers, including
+// the statuses of commands killed by a signal, into names.
+func listSignals(args []string, std streams) int {
+	if len(args) == 0 {
+		return std.print("kill", signalTable())
+	}
+	var output strings.Builder
+	status := 0
+	for _, arg := range args {
+		if n, err := strconv.Atoi(arg); err == nil {
+			if n > 128 {
+				n -= 128
+			}
+			if _, name, ok := parseSignal(strconv.Itoa(n)); ok {
+				output.WriteString(name + "\n")
+				continue
+			}
+		} else if sig, _, ok := parseSignal(arg); ok {
+			fmt.Fprintf(&output, "%d\n", sig)
+			continue
+		}
+		fmt.Fprintf(std.err, "gosh: kill: %s: invalid signal specification\n", arg)
+		status = 1
+	}
+	if std.print("kill", output.String()) != 0 {
+		return 1
+	}
+	return status
+}
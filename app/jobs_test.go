@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestBackgroundJobDoesNotChangeShell(t *testing.T) {
+	stdout, _, _ := runGosh(t, `cd /tmp
+x=1
+cd / &
+x=2 &
+sleep 0.2
+echo "$PWD $x"
+`)
+	if want := "/tmp 1\n"; stdout != want {
+		t.Errorf("got %q, want %q", stdout, want)
+	}
+}
+
+func TestCoprocReadsAndWrites(t *testing.T) {
+	stdout, _, _ := runGosh(t, `coproc C { read line; echo "got $line"; }
+echo hello >&"${C[1]}"
+read reply <&"${C[0]}"
+echo "$reply"
+`)
+	if want := "got hello\n"; stdout != want {
+		t.Errorf("got %q, want %q", stdout, want)
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// rlimitInfo describes a resource ulimit can show and set, with the
+// number of bytes or seconds its values count in.
+type rlimitInfo struct {
+	flag        byte
+	resource    int
+	description string
+	unit        string
+	scale       uint64
+}
+
+var rlimits = []rlimitInfo{
+	{'c', unix.RLIMIT_CORE, "core file size", "blocks", 1024},
+	{'d', unix.RLIMIT_DATA, "data seg size", "kbytes", 1024},
+	{'f', unix.RLIMIT_FSIZE, "file size", "blocks", 1024},
+	{'n', unix.RLIMIT_NOFILE, "open files", "", 1},
+	{'s', unix.RLIMIT_STACK, "stack size", "kbytes", 1024},
+	{'t', unix.RLIMIT_CPU, "cpu time", "seconds", 1},
+	{'u', unix.RLIMIT_NPROC, "max user processes", "", 1},
+	{'v', unix.RLIMIT_AS, "virtual memory", "kbytes", 1024},
+}
+
+func findRlimit(flag byte) (rlimitInfo, bool) {
+	for _, info := range rlimits {
+		if info.flag == flag {
+			return info, true
+		}
+	}
+	return rlimitInfo{}, false
+}
+
+func (info rlimitInfo) format(value uint64) string {
+	if value == unix.RLIM_INFINITY {
+		return "unlimited"
+	}
+	return strconv.FormatUint(value/info.scale, 10)
+}
+
+func (info rlimitInfo) header() string {
+	units := "(-" + string(info.flag) + ")"
+	if info.unit != "" {
+		units = "(" + info.unit + ", -" + string(info.flag) + ")"
+	}
+	return fmt.Sprintf("%-28s%12s ", info.description, units)
+}
+
+// getRlimit returns the limits the commands the shell starts inherit.
+// These are the shell's own except for open files, whose soft limit the
+// Go runtime raises to one below the hard limit for the shell alone and
+// restores in every process it starts.
+func getRlimit(resource int) (unix.Rlimit, error) {
+	var limit unix.Rlimit
+	if err := unix.Getrlimit(resource, &limit); err != nil {
+		return limit, err
+	}
+	if resource == unix.RLIMIT_NOFILE && limit.Cur == limit.Max-1 {
+		if inherited, err := childNofileLimit(); err == nil {
+			limit.Cur = inherited.Cur
+		}
+	}
+	return limit, nil
+}
+
+// childNofileLimit reads the open files limit of a child, which is held
+// stopped by ptrace as soon as it has been executed, before the runtime
+// in it can raise the limit again.
+func childNofileLimit() (unix.Rlimit, error) {
+	var limit unix.Rlimit
+	self, err := os.Executable()
+	if err != nil {
+		return limit, err
+	}
+	child, err := os.StartProcess(self, []string{self}, &os.ProcAttr{
+		Sys: &syscall.SysProcAttr{Ptrace: true},
+	})
+	if err != nil {
+		return limit, err
+	}
+	err = unix.Prlimit(child.Pid, unix.RLIMIT_NOFILE, nil, &limit)
+	child.Kill()
+	child.Wait()
+	return limit, err
+}
+
+// Ulimit shows or sets the shell's resource limits, which the commands it
+// starts inherit. Without -S or -H a new value sets both limits, and the
+// soft limit is the one shown.
+func Ulimit(command []string, std streams) int {
+	args := command[1:]
+	soft, hard, all := false, false, false
+	var selected []rlimitInfo
+	for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+		arg := args[0]
+		args = args[1:]
+		if arg == "--" {
+			break
+		}
+		for _, flag := range []byte(arg[1:]) {
+			switch flag {
+			case 'S':
+				soft = true
+			case 'H':
+				hard = true
+			case 'a':
+				all = true
+			default:
+				info, ok := findRlimit(flag)
+				if !ok {
+					fmt.Fprintf(std.err, "gosh: ulimit: -%c: invalid option\n", flag)
+					fmt.Fprintln(std.err, "ulimit: usage: ulimit [-SHacdfnstuv] [limit]")
+					return 2
+				}
+				selected = append(selected, info)
+			}
+		}
+	}
+	if all {
+		selected = rlimits
+	}
+	if len(selected) == 0 {
+		selected = []rlimitInfo{rlimits[2]}
+	}
+	if len(args) > 1 || len(args) == 1 && all {
+		fmt.Fprintln(std.err, "gosh: ulimit: too many arguments")
+		return 2
+	}
+
+	if len(args) == 1 {
+		status := 0
+		for _, info := range selected {
+			if err := setRlimit(info, args[0], soft, hard); err != nil {
+				fmt.Fprintf(std.err, "gosh: ulimit: %s: %s\n", info.description, err)
+				status = 1
+			}
+		}
+		return status
+	}
+
+	var output strings.Builder
+	for _, info := range selected {
+		limit, err := getRlimit(info.resource)
+		if err != nil {
+			fmt.Fprintf(std.err, "gosh: ulimit: %s: cannot get limit: %s\n", info.description, errorText(err))
+			return 1
+		}
+		value := limit.Cur
+		if hard && !soft {
+			value = limit.Max
+		}
+		if len(selected) > 1 {
+			output.WriteString(info.header())
+		}
+		output.WriteString(info.format(value) + "\n")
+	}
+	return std.print("ulimit", output.String())
+}
+
+// setRlimit sets the soft limit, the hard limit or both to value, which
+// is a number in the resource's unit, unlimited, soft or hard.
+func setRlimit(info rlimitInfo, value string, soft, hard bool) error {
+	if !soft && !hard {
+		soft, hard = true, true
+	}
+	limit, err := getRlimit(info.resource)
+	if err != nil {
+		return fmt.Errorf("cannot get limit: %s", errorText(err))
+	}
+	var n uint64
+	switch value {
+	case "unlimited":
+		n = unix.RLIM_INFINITY
+	case "soft":
+		n = limit.Cur
+	case "hard":
+		n = limit.Max
+	default:
+		parsed, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number")
+		}
+		if parsed > unix.RLIM_INFINITY/info.scale {
+			return fmt.Errorf("value too large")
+		}
+		n = parsed * info.scale
+	}
+	if soft {
+		limit.Cur = n
+	}
+	if hard {
+		limit.Max = n
+	}
+	if err := unix.Setrlimit(info.resource, &limit); err != nil {
+		return fmt.Errorf("cannot modify limit: %s", errorText(err))
+	}
+	return nil
+}
+
+// currentUmask reads the file mode creation mask, which can only be done
+// by setting it.
+func currentUmask() int {
+	mask := unix.Umask(0)
+	unix.Umask(mask)
+	return mask
+}
+
+func Umask(command []string, std streams) int {
+	args := command[1:]
+	symbolic, reusable := false, false
+	for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+		arg := args[0]
+		args = args[1:]
+		if arg == "--" {
+			break
+		}
+		for _, flag := range arg[1:] {
+			switch flag {
+			case 'S':
+				symbolic = true
+			case 'p':
+				reusable = true
+			default:
+				fmt.Fprintf(std.err, "gosh: umask: -%c: invalid option\n", flag)
+				fmt.Fprintln(std.err, "umask: usage: umask [-p] [-S] [mode]")
+				return 2
+			}
+		}
+	}
+
+	mask := currentUmask()
+	if len(args) == 0 {
+		text := fmt.Sprintf("%04o", mask)
+		if symbolic {
+			text = symbolicMode(0o777 &^ mask)
+		}
+		if reusable {
+			if symbolic {
+				text = "-S " + text
+			}
+			text = "umask " + text
+		}
+		return std.print("umask", text+"\n")
+	}
+
+	if args[0][0] >= '0' && args[0][0] <= '9' {
+		n, err := strconv.ParseUint(args[0], 8, 32)
+		if err != nil || n > 0o777 {
+			fmt.Fprintf(std.err, "gosh: umask: %s: octal number out of range\n", args[0])
+			return 1
+		}
+		mask = int(n)
+	} else {
+		perm, ok := applySymbolicMode(0o777&^mask, args[0])
+		if !ok {
+			fmt.Fprintf(std.err, "gosh: umask: `%s': invalid symbolic mode operator\n", args[0])
+			return 1
+		}
+		mask = 0o777 &^ perm
+	}
+	unix.Umask(mask)
+	if symbolic {
+		return std.print("umask", symbolicMode(0o777&^mask)+"\n")
+	}
+	return 0
+}
+
+// symbolicMode writes permission bits as umask -S shows them, such as
+// u=rwx,g=rx,o=rx.
+func symbolicMode(perm int) string {
+	var parts []string
+	for i, who := range []string{"u", "g", "o"} {
+		bits := perm >> (6 - 3*i) & 7
+		part := who + "="
+		for j, letter := range "rwx" {
+			if bits&(4>>j) != 0 {
+				part += string(letter)
+			}
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, ",")
+}
+
+// applySymbolicMode applies a comma-separated list of clauses like u=rwx,
+// g-w or a+x to the permission bits perm.
+func applySymbolicMode(perm int, mode string) (int, bool) {
+	for _, clause := range strings.Split(mode, ",") {
+		who := 0
+		i := 0
+		for ; i < len(clause) && strings.IndexByte("ugoa", clause[i]) >= 0; i++ {
+			switch clause[i] {
+			case 'u':
+				who |= 0o700
+			case 'g':
+				who |= 0o070
+			case 'o':
+				who |= 0o007
+			case 'a':
+				who |= 0o777
+			}
+		}
+		if who == 0 {
+			who = 0o777
+		}
+		if i == len(clause) {
+			return 0, false
+		}
+		for i < len(clause) {
+			op := clause[i]
+			if op != '+' && op != '-' && op != '=' {
+				return 0, false
+			}
+			i++
+			bits := 0
+			for ; i < len(clause) && strings.IndexByte("rwx", clause[i]) >= 0; i++ {
+				switch clause[i] {
+				case 'r':
+					bits |= 0o444
+				case 'w':
+					bits |= 0o222
+				case 'x':
+					bits |= 0o111
+				}
+			}
+			if i < len(clause) && strings.IndexByte("+-=", clause[i]) < 0 {
+				return 0, false
+			}
+			switch op {
+			case '+':
+				perm |= bits & who
+			case '-':
+				perm &^= bits & who
+			case '=':
+				perm = perm&^who | bits&who
+			}
+		}
+	}
+	return perm, true
+}
@@ -0,0 +1,15 @@
+package main
+
+import "testing"
+
+func TestUlimitShowsInheritedOpenFiles(t *testing.T) {
+	stdout, stderr, _ := runGosh(t, `[ "$(ulimit -n)" = "$(sh -c 'ulimit -n')" ] && echo same
+ulimit -f 18014398509481984; echo $?
+`)
+	if want := "same\n1\n"; stdout != want {
+		t.Errorf("got %q, want %q", stdout, want)
+	}
+	if want := "gosh: ulimit: file size: value too large\n"; stderr != want {
+		t.Errorf("got stderr %q, want %q", stderr, want)
+	}
+}
@@ -1,33 +1,31 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"math"
 	"os"
 	"os/exec"
 	"slices"
 	"strings"
 	"time"
-	"sync"
 	"strconv"
 	"path/filepath"
+	"syscall"
 
 	"github.com/chzyer/readline"
 )
 
-var builtin = map[string]bool{
-	"echo" : true,
-	"exit" : true, 
-	"pwd" : true, 
-	"type" : true, 
-	"cd" : true,
-	"history" : true,
-}
-
-var currHistory = make([]string, 0, 500)
+var currHistory = make([]histEntry, 0, 500)
 var currHistoryInit int = 1
 
+// savedHistory holds the entries already in the history file that are
+// kept in memory, at most HISTSIZE of them, numbered up to currHistoryInit.
+var savedHistory []histEntry
+var lastStatus int
+
 type bellCompleter struct {
 	readline.AutoCompleter
 	lastTabTime    time.Time
@@ -36,10 +34,8 @@ type bellCompleter struct {
 
 func initCompleters() []readline.PrefixCompleterInterface {
 	uniqueStrings := make(map[string]bool, 5000)
-	for key, val := range builtin {
-		if val {
-			uniqueStrings[key] = true
-		}
+	for key := range builtins {
+		uniqueStrings[key] = true
 	}
 	path := os.Getenv("PATH")
 	pathSlice := strings.Split(path, ":")
@@ -118,118 +114,549 @@ func (bc *bellCompleter) Do(line []rune, pos int) (newLine [][]rune, length int)
 	return nil, length
 }
 
-func Echo(command []string) (print string) {
-	size, flag := checkRedirectRequest(command)
-	if size == -1 {
-		size = len(command)
+func Echo(command []string, std streams) int {
+	args := command[1:]
+	newline, escapes := true, false
+	for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' && strings.Trim(args[0][1:], "neE") == "" {
+		for _, c := range args[0][1:] {
+			switch c {
+			case 'n':
+				newline = false
+			case 'e':
+				escapes = true
+			case 'E':
+				escapes = false
+			}
+		}
+		args = args[1:]
 	}
 
-	if size == 1 {
-		print = "\n"
-	} else {
-		print = strings.Join(command[1:size], " ")
+	print := strings.Join(args, " ")
+	if escapes {
+		var expanded strings.Builder
+		if expandEscapes(print, &expanded, true) {
+			newline = false
+		}
+		print = expanded.String()
+	}
+	if newline {
 		print += "\n"
 	}
-	if flag != -1 {
-		print := redirectEchoToFile(command, size, print, flag)
-		return print
+	return std.print("echo", print)
+}
+
+func Type(command []string, std streams) int {
+	args := command[1:]
+	var flags typeFlags
+	for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+		arg := args[0]
+		args = args[1:]
+		if arg == "--" {
+			break
+		}
+		for _, flag := range arg[1:] {
+			switch flag {
+			case 'a':
+				flags.all = true
+			case 'f':
+				flags.noFunctions = true
+			case 't':
+				flags.kind = true
+			case 'p':
+				flags.pathOnly = true
+			case 'P':
+				flags.pathOnly, flags.forcePath = true, true
+			default:
+				fmt.Fprintf(std.err, "gosh: type: -%c: invalid option\n", flag)
+				fmt.Fprintln(std.err, "type: usage: type [-afptP] name [name ...]")
+				return 2
+			}
+		}
 	}
-	return
+
+	status := 0
+	for _, name := range args {
+		lines, found := describeCommand(name, flags)
+		if !found {
+			if !flags.kind && !flags.pathOnly {
+				fmt.Fprintf(std.err, "gosh: type: %s: not found\n", name)
+			}
+			status = 1
+		}
+		for _, line := range lines {
+			if std.print("type", line+"\n") != 0 {
+				return 1
+			}
+		}
+	}
+	return status
+}
+
+type typeFlags struct {
+	all         bool // every match, not just the one that would run
+	noFunctions bool
+	kind        bool // one word naming the kind of each match
+	pathOnly    bool // only the paths of files
+	forcePath   bool // search PATH even for names that are not files
 }
 
-func Type(command []string) (print string) {
-	if len(command) == 1 {
-		print = ""
+// describeCommand lists what name would run as, in the order gosh looks:
+// alias, reserved word, function, builtin, then file. It reports whether
+// anything matched, since with -p only files are listed.
+func describeCommand(name string, flags typeFlags) (lines []string, matched bool) {
+	found := func(kind, description string) bool {
+		matched = true
+		if flags.kind {
+			lines = append(lines, kind)
+		} else if !flags.pathOnly {
+			lines = append(lines, description)
+		}
+		return !flags.all
+	}
+	if !flags.forcePath {
+		if value, ok := aliases[name]; ok && found("alias", fmt.Sprintf("%s is aliased to `%s'", name, value)) {
+			return
+		}
+		if reservedWords[name] && found("keyword", name+" is a shell keyword") {
+			return
+		}
+		if _, ok := functions[name]; ok && !flags.noFunctions && found("function", name+" is a function") {
+			return
+		}
+		if builtins[name] != nil && found("builtin", name+" is a shell builtin") {
+			return
+		}
+		if flags.pathOnly && matched {
+			return
+		}
+	}
+
+	var paths []string
+	if strings.Contains(name, "/") {
+		if isExecutable(name) {
+			paths = []string{name}
+		}
+	} else if hashed, ok := hashedPath(name); ok && !flags.all {
+		if flags.pathOnly && !flags.kind {
+			return append(lines, hashed), true
+		}
+		found("file", fmt.Sprintf("%s is hashed (%s)", name, hashed))
+		return
 	} else {
-		for i := 1; i < len(command); i++ {
-			if builtin[command[i]] {
-				print += fmt.Sprintf("%s is a shell builtin\n", command[i])
-			} else {
-				foundExec, fullPath := findExec(command[i])
-				if foundExec {
-					print += fmt.Sprintf("%s is %s\n", command[i], fullPath)
-				} else {
-					print += fmt.Sprintf("%s: not found\n", command[i])
-				}
-			}
+		paths = searchPath(name, flags.all)
+	}
+	for _, path := range paths {
+		if flags.pathOnly && !flags.kind {
+			lines = append(lines, path)
+			matched = true
+		} else {
+			found("file", fmt.Sprintf("%s is %s", name, path))
 		}
 	}
 	return
 }
 
-func Pwd() string {
-	path, err := os.Getwd()
+func getHistoryPath() string {
+	if envPath := os.Getenv("HISTFILE"); envPath != "" {
+		return envPath
+	}
+	home, err := os.UserHomeDir()
 	if err != nil {
-		log.Fatal(err)
+		// Without a home directory there is nowhere to keep history, and
+		// reading and writing "" fails quietly.
+		return ""
 	}
-	return fmt.Sprintf("%s\n", path)
+	return home + "/.gosh_history"
 }
 
-func Cd(command []string) string {
-	if len(command) == 1 || command[1] == "~" {
-		home, err := os.UserHomeDir()
-		if err != nil {
-			log.Fatal(err)
+// histEntry is a command in the history and when it was entered. Entries
+// read from a file written before timestamps were kept have a zero time.
+type histEntry struct {
+	text string
+	time time.Time
+}
+
+// String writes the entry as it is kept in a history file: a #epoch
+// comment line, as bash writes them, followed by the command. The lines
+// of a command typed over several lines follow the one #epoch line; an
+// entry with no time but several lines is given #0, so that it is read
+// back whole too.
+func (e histEntry) String() string {
+	switch {
+	case !e.time.IsZero():
+		return fmt.Sprintf("#%d\n%s\n", e.time.Unix(), e.text)
+	case strings.Contains(e.text, "\n"):
+		return "#0\n" + e.text + "\n"
+	}
+	return e.text + "\n"
+}
+
+// parseHistory reads the entries of a history file. A #epoch line gives
+// the time of the command that follows it, and every line up to the next
+// #epoch line is part of that command; #0 marks a command with no time.
+// Lines before the first #epoch line, as in files written before
+// timestamps were kept, are a command each.
+func parseHistory(content string) []histEntry {
+	var entries []histEntry
+	stamped := false
+	for _, line := range strings.Split(strings.TrimRight(content, "\n"), "\n") {
+		if stamp, ok := historyStamp(line); ok {
+			entries = append(entries, histEntry{"", stamp})
+			stamped = true
+			continue
 		}
-		err = os.Chdir(home)
-		if err != nil {
-			log.Fatal(err)
+		switch {
+		case !stamped:
+			if line != "" {
+				entries = append(entries, histEntry{line, time.Time{}})
+			}
+		case entries[len(entries)-1].text == "":
+			entries[len(entries)-1].text = line
+		default:
+			entries[len(entries)-1].text += "\n" + line
 		}
-	} else {
-		fileInfo, err := os.Stat(command[1])
-		if err == nil && fileInfo.IsDir() {
-			err = os.Chdir(command[1])
-			if err != nil {
-				log.Fatal(err)
+	}
+	return slices.DeleteFunc(entries, func(e histEntry) bool { return e.text == "" })
+}
+
+// historyStamp reads a #epoch line of a history file, where #0 stands for
+// no time.
+func historyStamp(line string) (time.Time, bool) {
+	if len(line) < 2 || line[0] != '#' || !isDigits(line[1:]) {
+		return time.Time{}, false
+	}
+	seconds, err := strconv.ParseInt(line[1:], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	if seconds == 0 {
+		return time.Time{}, true
+	}
+	return time.Unix(seconds, 0), true
+}
+
+func readHistoryFile(path string) ([]histEntry, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseHistory(string(content)), nil
+}
+
+// readHistoryTail returns the last n entries of a history file, or all of
+// them when n is negative, and reports whether the file holds more. It
+// reads backwards from the end, counting #epoch lines, until it has passed
+// the start of the n entries, so that a huge file costs no more than the
+// part that is kept. A file without #epoch lines, where each line is an
+// entry, is read whole.
+func readHistoryTail(path string, n int) ([]histEntry, bool, error) {
+	if n < 0 {
+		entries, err := readHistoryFile(path)
+		return entries, false, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, false, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, false, err
+	}
+
+	// chunks holds what has been read, the end of the file first, and
+	// unscanned the start of it, which may be the end of a longer line.
+	const chunkSize = 64 * 1024
+	var chunks [][]byte
+	var unscanned []byte
+	offset := info.Size()
+	stamps, cut := 0, offset
+	for offset > 0 && stamps <= n {
+		size := min(chunkSize, offset)
+		offset -= size
+		chunk := make([]byte, size)
+		if _, err := file.ReadAt(chunk, offset); err != nil {
+			return nil, false, err
+		}
+		chunks = append(chunks, chunk)
+
+		data := append(chunk[:size:size], unscanned...)
+		start := 0
+		if offset > 0 {
+			newline := bytes.IndexByte(data, '\n')
+			if newline < 0 {
+				unscanned = data
+				continue
+			}
+			start = newline + 1
+		}
+		lines := bytes.SplitAfter(data[start:], []byte("\n"))
+		pos := offset + int64(len(data))
+		for i := len(lines) - 1; i >= 0 && stamps <= n; i-- {
+			pos -= int64(len(lines[i]))
+			if _, ok := historyStamp(strings.TrimSuffix(string(lines[i]), "\n")); ok {
+				stamps++
+				if stamps == n {
+					cut = pos
+				}
 			}
-		} else {
-			return fmt.Sprintf("cd: %s: No such file or directory\n", command[1])
 		}
+		unscanned = data[:start]
 	}
-	return ""
+
+	content := make([]byte, 0, info.Size()-offset)
+	for i := len(chunks) - 1; i >= 0; i-- {
+		content = append(content, chunks[i]...)
+	}
+	if stamps > n {
+		return parseHistory(string(content[cut-offset:])), true, nil
+	}
+	entries := parseHistory(string(content))
+	return entries[max(0, len(entries)-n):], len(entries) > n, nil
 }
 
-func getHistoryPath() string {
-    home, err := os.UserHomeDir()
+// writeHistoryFile replaces a history file with entries by writing them to
+// a temporary file beside it and renaming that over it, so that a crash
+// leaves either the old file or the new one.
+func writeHistoryFile(path string, entries []histEntry) error {
+	temp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
 	if err != nil {
-		fmt.Print("Error accessing home directory! : ")
-		log.Fatal(err)
+		return err
+	}
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	err = writeHistory(temp, entries)
+	if err == nil {
+		err = temp.Chmod(mode)
+	}
+	if err == nil {
+		err = temp.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+	}
+	return err
+}
+
+// historyLimit reads a size variable such as HISTSIZE, returning -1 for no
+// limit, which is what a negative or non-numeric value means.
+func historyLimit(name string, fallback int) int {
+	value, set := os.LookupEnv(name)
+	if !set {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return -1
+	}
+	return n
+}
+
+// histSize is the number of entries kept in memory and loaded from the
+// history file, 500 unless HISTSIZE says otherwise, as in bash.
+func histSize() int {
+	return historyLimit("HISTSIZE", 500)
+}
+
+// histFileSize is the number of entries the history file is cut down to.
+// Unlike HISTSIZE it has no default of its own, so that a history file,
+// which other shells may share, is only cut when the user has asked for
+// a limit with HISTFILESIZE or HISTSIZE.
+func histFileSize() int {
+	return historyLimit("HISTFILESIZE", historyLimit("HISTSIZE", -1))
+}
+
+// trimHistory drops the oldest entries held in memory beyond HISTSIZE.
+func trimHistory() {
+	size := histSize()
+	if size < 0 {
+		return
+	}
+	if extra := len(savedHistory) + len(currHistory) - size; extra > 0 {
+		dropped := min(extra, len(savedHistory))
+		savedHistory = savedHistory[dropped:]
+		if extra -= dropped; extra > 0 {
+			currHistory = currHistory[extra:]
+			currHistoryInit += extra
+		}
 	}
-    filePath := home + "/.gosh_history"
-	if envPath := os.Getenv("HISTFILE"); envPath != "" {
-		return envPath
-    }
-	return filePath
 }
 
+// allHistory is the history as it is listed, oldest first.
+func allHistory() []histEntry {
+	return append(slices.Clone(savedHistory), currHistory...)
+}
+
+func writeHistory(file *os.File, entries []histEntry) error {
+	var buf strings.Builder
+	for _, entry := range entries {
+		buf.WriteString(entry.String())
+	}
+	_, err := file.WriteString(buf.String())
+	return err
+}
+
+// saveToHistory appends the session's commands to the history file, then
+// cuts the file down to its last HISTFILESIZE entries.
 func saveToHistory() {
 	historyPath := getHistoryPath()
-	file, err := os.OpenFile(historyPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
+	unlock := lockHistory(historyPath, true)
+	defer unlock()
+	appendHistoryFile(historyPath, currHistory)
+}
+
+func truncateHistoryFile(path string) {
+	limit := histFileSize()
+	if limit < 0 {
 		return
 	}
-	defer file.Close()
-	for _, val := range currHistory {
-		val += "\n"
-		data := []byte(val)
-		_, err = file.Write(data)
-		if err != nil {
-			file.Close()
-			return
-		}
+	entries, more, err := readHistoryTail(path, limit)
+	if err == nil && more {
+		writeHistoryFile(path, entries)
 	}
 }
 
 func appendToCurrHistory(rawCommand string) {
-	currHistory = append(currHistory, rawCommand)
+	// Keep whole seconds, as the history file does.
+	currHistory = append(currHistory, histEntry{rawCommand, time.Unix(time.Now().Unix(), 0)})
+	trimHistory()
+}
+
+// recordHistory adds a command line to the history unless HISTCONTROL or
+// HISTIGNORE leave it out, keeping readline's copy the same as the one
+// that is saved.
+func recordHistory(rl *readline.Instance, line string) {
+	if !keepInHistory(line) {
+		return
+	}
+	if histControl("erasedups") && eraseHistoryDups(line) {
+		rl.ResetHistory()
+		for _, entry := range allHistory() {
+			rl.SaveHistory(entry.text)
+		}
+	}
+	appendToCurrHistory(line)
+	rl.SaveHistory(line)
+	if shoptOptions["inc_append_history"] || shoptOptions["share_history"] {
+		appendHistoryNow()
+	}
+}
+
+// histControl reports whether HISTCONTROL includes option, where
+// ignoreboth stands for ignorespace and ignoredups.
+func histControl(option string) bool {
+	for _, value := range strings.Split(os.Getenv("HISTCONTROL"), ":") {
+		if value == option || value == "ignoreboth" && (option == "ignorespace" || option == "ignoredups") {
+			return true
+		}
+	}
+	return false
+}
+
+// previousHistoryLine returns the most recent history entry.
+func previousHistoryLine() string {
+	if entries := allHistory(); len(entries) > 0 {
+		return entries[len(entries)-1].text
+	}
+	return ""
+}
+
+// keepInHistory applies HISTCONTROL's ignorespace and ignoredups and the
+// colon-separated patterns of HISTIGNORE, in which & stands for the
+// previous history line, to a line about to be recorded.
+func keepInHistory(line string) bool {
+	if histControl("ignorespace") && (line[0] == ' ' || line[0] == '\t') {
+		return false
+	}
+	previous := previousHistoryLine()
+	if histControl("ignoredups") && line == previous {
+		return false
+	}
+	for _, pattern := range strings.Split(os.Getenv("HISTIGNORE"), ":") {
+		if pattern == "" {
+			continue
+		}
+		pattern = strings.ReplaceAll(pattern, "&", escapeGlob(previous))
+		if matchPattern(pattern, line) {
+			return false
+		}
+	}
+	return true
 }
 
-func History(command []string) string {
+// erasedHistory holds the lines erasedups has removed from the history in
+// memory, which are removed from the history file when it is next
+// written, rather than rewriting it for every command.
+var erasedHistory = map[string]bool{}
+
+// eraseHistoryDups removes earlier copies of line from the history,
+// reporting whether there were any.
+func eraseHistoryDups(line string) bool {
+	isDup := func(entry histEntry) bool { return entry.text == line }
+	before := len(currHistory)
+	currHistory = slices.DeleteFunc(currHistory, isDup)
+	erased := before != len(currHistory)
+	before = len(savedHistory)
+	savedHistory = slices.DeleteFunc(savedHistory, isDup)
+	if len(savedHistory) != before {
+		currHistoryInit -= before - len(savedHistory)
+		erased = true
+	}
+	erasedHistory[line] = true
+	return erased
+}
+
+// matchPattern matches s against a shell pattern as a whole, where unlike
+// in pathname expansion * and ? also match /.
+func matchPattern(pattern, s string) bool {
+	matched, _ := filepath.Match(strings.ReplaceAll(pattern, "/", "\x00"), strings.ReplaceAll(s, "/", "\x00"))
+	return matched
+}
+
+// escapeGlob quotes the characters of s that a pattern would treat
+// specially.
+func escapeGlob(s string) string {
+	var escaped strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(`*?[\`, c) {
+			escaped.WriteByte('\\')
+		}
+		escaped.WriteRune(c)
+	}
+	return escaped.String()
+}
+
+// formatHistoryTime prefixes a history listing line with the entry's
+// time in the strftime format of HISTTIMEFORMAT, when that is set.
+func formatHistoryTime(entry histEntry) string {
+	format, set := os.LookupEnv("HISTTIMEFORMAT")
+	if !set {
+		return ""
+	}
+	if entry.time.IsZero() {
+		return "??"
+	}
+	return strftime(format, entry.time)
+}
+
+func History(command []string, std streams) int {
+	if len(command) == 2 && command[1] == "-n" {
+		readNewHistory()
+		return 0
+	}
 	if len(command) > 2 && command[1] == "-r" {
 		if strings.HasPrefix(command[2], "~") {
 			home, err := os.UserHomeDir()
 			if err != nil {
-				return ""
+				return 1
 			}
 			if command[2] == "~" {
 				command[2] = home
@@ -239,33 +666,23 @@ func History(command []string) string {
     	}
 		absPath, err := filepath.Abs(command[2])
 		if err != nil {
-			return ""
+			return 1
 		}
 		command[2] = string(absPath)
-		content, err := os.ReadFile(command[2])
+		entries, err := readHistoryFile(command[2])
 		if err != nil {
-			return ""
+			return 1
 		}
-		lines := strings.Split(string(content), "\n")
-		for _, line := range lines {
-			if line != "" {
-				currHistory = append(currHistory, line)
-			}
-		}
-		return ""
+		currHistory = append(currHistory, entries...)
+		return 0
 	}
-	return history(command)
+	return std.print("history", history(command))
 }
 
 func history(command []string) string {
-
-	content, err := os.ReadFile(getHistoryPath())
-	if err != nil {
-		return ""
-	}
-	lines := strings.Split(string(content), "\n")
+	entries := allHistory()
 	var output strings.Builder
-	var maxLimit int = len(lines) + len(currHistory)
+	var maxLimit int = len(entries)
 
 	if len(command) > 1 {
 		if val ,err := strconv.Atoi(command[1]); err == nil {
@@ -275,17 +692,9 @@ func history(command []string) string {
 		} 
 	}
 
-	if len(currHistory) < maxLimit {
-		for i := max(0, len(lines) + len(currHistory) - maxLimit - 1); i < len(lines); i++ {
-			if lines[i] != "" {
-				fmt.Fprintf(&output, "%5d  %s\n", i+1, lines[i])
-			}
-		}
-	}
-	for i := max(0, len(currHistory) - maxLimit); i < len(currHistory); i++ {
-		if currHistory[i] != "" {
-			fmt.Fprintf(&output, "%5d  %s\n", currHistoryInit + i, currHistory[i])
-		}
+	first := currHistoryInit - len(savedHistory)
+	for i := max(0, len(entries) - maxLimit); i < len(entries); i++ {
+		fmt.Fprintf(&output, "%5d  %s%s\n", first + i, formatHistoryTime(entries[i]), entries[i].text)
 	}
 	return output.String()
 }
@@ -312,342 +721,124 @@ func editHistoryFile(command []string) string {
 	}
 	command[2] = string(absPath)
 
+	unlock := lockHistory(command[2], true)
+	defer unlock()
 	if command[1] == "-w" {
-		file, err := os.OpenFile(command[2], os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
-		if err != nil {
-			return ""
-		}
-		defer file.Close()
-		for _, line := range currHistory {
-			if line != "" {
-				if _, err := file.WriteString(line + "\n"); err != nil {
-					return ""
-				}
-			}
+		entries := allHistory()
+		if writeHistoryFile(command[2], entries) == nil && command[2] == historyFileState.path {
+			markHistoryRead(command[2], entries)
+			clear(erasedHistory)
 		}
 	} else {
-		file, err := os.OpenFile(command[2], os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-		if err != nil {
+		if appendHistoryFile(command[2], currHistory) != nil {
 			return ""
 		}
-		defer file.Close()
-		for _, line := range currHistory {
-			if _, err := file.WriteString(line + "\n"); err != nil {
-				return ""
-			}
-		}
+		// The session's entries are in the file now, and must not be
+		// appended again on exit.
 		currHistoryInit = currHistoryInit + len(currHistory)
-		saveToHistory()
-		currHistory = make([]string, 0, 500)
+		savedHistory = append(savedHistory, currHistory...)
+		currHistory = make([]histEntry, 0, 500)
 	}
 	return ""
 }
 
 func findExec(program string) (bool, string) {
+	paths := searchPath(program, false)
+	if len(paths) == 0 {
+		return false, ""
+	}
+	return true, paths[0]
+}
+
+// searchPath returns the first executable called program in PATH, or with
+// all set every one of them in PATH order.
+func searchPath(program string, all bool) (paths []string) {
 	path := os.Getenv("PATH")
 	pathSlice := strings.Split(path, ":")
 	var fullPath string
 
 	for j := 0; j < len(pathSlice); j++ {
-		if pathSlice[j][len(pathSlice[j])-1] != '/' {
-			fullPath = pathSlice[j] + "/" + program
+		dir := pathSlice[j]
+		if dir == "" { // an empty entry means the current directory
+			dir = "."
+		}
+		if dir[len(dir)-1] != '/' {
+			fullPath = dir + "/" + program
 		} else {
-			fullPath = pathSlice[j] + program
+			fullPath = dir + program
 		}
 
-		fileInfo, err := os.Stat(fullPath)
-		if err == nil {
-			mode := fileInfo.Mode()
-			if mode&0b001001001 != 0 { // mode is stored as rwxrwxrwx
-				return true, fullPath
+		if isExecutable(fullPath) {
+			paths = append(paths, fullPath)
+			if !all {
+				return
 			}
 		}
 	}
-	return false, ""
-}
-
-func isExec(command []string) bool {
-	foundExec, _ := findExec(command[0])
-	return foundExec
-}
-
-func returnExec(command []string) (cmd *exec.Cmd, outFile *os.File) {
-	index, flag := checkRedirectRequest(command)
-	var err error
-	if flag == 1 {
-		outFile, err = os.Create(command[index+1])
-		if err != nil {
-			log.Fatal(err)
-		}
-		cmd = exec.Command(command[0], command[1:index]...)
-		cmd.Stdout = outFile
-		cmd.Stderr = os.Stderr
-	} else if flag == 2 {
-		outFile, err = os.Create(command[index+1])
-		if err != nil {
-			log.Fatal(err)
-		}
-		cmd = exec.Command(command[0], command[1:index]...)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = outFile
-	} else if flag == 3 {
-		outFile, err = os.OpenFile(command[index+1], os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-		if err != nil {
-			log.Fatal(err)
-		}
-		cmd = exec.Command(command[0], command[1:index]...)
-		cmd.Stdout = outFile
-		cmd.Stderr = os.Stderr
-	} else if flag == 4 {
-		outFile, err = os.OpenFile(command[index+1], os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-		if err != nil {
-			log.Fatal(err)
-		}
-		cmd = exec.Command(command[0], command[1:index]...)
-		cmd.Stderr = outFile
-		cmd.Stdout = os.Stdout
-	} else {
-		cmd = exec.Command(command[0], command[1:]...)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		return cmd, nil
-	}
 	return
 }
 
-func RunExec(command []string) {
-	cmd, outFile := returnExec(command)
-	if outFile != nil {
-		defer outFile.Close()
-	}
-	err := cmd.Run()
-	// if err != nil {
-	// 	// _, fullPath := findExec(command[0])
-	// 	// fmt.Printf("Something went wrong! Could not execute %s\n", fullPath)
-	// 	// log.Fatal(err)
-	// }
-	var _ = err
-}
-
-func checkRedirectRequest(command []string) (int, int) {
-	index := slices.IndexFunc(command, func(c string) bool {
-		return c == "1>" || c == ">" || c == "2>" || c == "1>>" || c == ">>" || c == "2>>"
-	})
-	if index == -1 {
-		return index, -1
-	} else if command[index] == "2>" {
-		return index, 2
-	} else if command[index] == "2>>" {
-		return index, 4
-	} else if command[index] == "1>" || command[index] == ">" {
-		return index, 1
-	} else {
-		return index, 3
+func RunExec(command []string, path string, std stdio) {
+	cmd := &exec.Cmd{Path: path, Args: command}
+	if std.in != nil {
+		cmd.Stdin = std.in
 	}
-}
-
-func redirectEchoToFile(command []string, index int, print string, flag int) string {
-	if len(command) == index+1 {
-		fmt.Println("No output file specified!!")
-		return ""
+	if std.out != nil {
+		cmd.Stdout = std.out
 	}
-
-	switch flag {
-	case 1:
-		data := []byte(print + strings.Join(command[min(index+2, len(command)):], " "))
-		err := os.WriteFile(command[index+1], data, 0644)
-		if err != nil {
-			log.Fatal(err)
-		}
-	case 2:
-		data := []byte("")
-		err := os.WriteFile(command[index+1], data, 0644)
-		if err != nil {
-			log.Fatal(err)
-		}
-		return print
-	case 3:
-		data := []byte(print + strings.Join(command[min(index+2, len(command)):], " "))
-		file, err := os.OpenFile(command[index+1], os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-		if err != nil {
-			log.Fatal(err)
-		}
-		defer file.Close()
-		_, err = file.Write(data)
-		if err != nil {
-			file.Close()
-			log.Fatal(err)
-		}
-	case 4:
-		data := []byte("")
-		file, err := os.OpenFile(command[index+1], os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-		if err != nil {
-			log.Fatal(err)
-		}
-		defer file.Close()
-		_, err = file.Write(data)
-		if err != nil {
-			file.Close()
-			log.Fatal(err)
-		}
-		return print
+	if std.err != nil {
+		cmd.Stderr = std.err
 	}
-	return ""
-}
-
-func commandParser(rawCommand string) (command []string) {
-	var startingQuote byte
-	var temp string = ""
-	var insideWord bool = false
-	for i := 0; i < len(rawCommand); i++ {
-		if insideWord {
-			if rawCommand[i] == startingQuote {
-				insideWord = false
-			} else if startingQuote == '"' && rawCommand[i] == '\\' {
-				if i + 1 < len(rawCommand) {
-					if rawCommand[i + 1] == '"' || rawCommand[i + 1] == '\\' || rawCommand[i + 1] == '`' || rawCommand[i + 1] == '$' {
-						temp += string(rawCommand[i + 1])
-						i++
-						continue
-					}
-				}
-				temp += string(rawCommand[i])
-			} else {
-				temp += string(rawCommand[i])
-			}
-		} else {
-			switch rawCommand[i] {
-			case '\'', '"':
-				startingQuote = rawCommand[i]
-				insideWord = true
-			case '\\':
-				if i + 1 < len(rawCommand) {
-					temp += string(rawCommand[i + 1])
-					i++
-				}
-			case ' ', '\n', '\t', '\r', '\f', '\v':
-				if temp != "" {
-					command = append(command, temp)
-					temp = ""
-				}
-			default:
-				temp += string(rawCommand[i])
-			}
+	cmd.ExtraFiles = std.extraFiles()
+	cmd, err := std.startProcess(cmd)
+	if errors.Is(err, syscall.ENOEXEC) {
+		// Not a binary and no #! line: run it as a gosh script, as POSIX
+		// shells do.
+		self, selfErr := os.Executable()
+		if selfErr == nil {
+			script := exec.Command(self, append([]string{path}, cmd.Args[1:]...)...)
+			script.Stdin, script.Stdout, script.Stderr = cmd.Stdin, cmd.Stdout, cmd.Stderr
+			script.ExtraFiles = cmd.ExtraFiles
+			cmd, err = std.startProcess(script)
 		}
 	}
-	if temp != "" {
-		command = append(command, temp)
-	}
-	return
-}
-
-func checkForEnvs(command *[]string) {
-	for idx, val := range *command {
-		(*command)[idx] = os.ExpandEnv(val)
+	if err == nil {
+		err = cmd.Wait()
+		addChildUsage(cmd.ProcessState)
+		std.processExited(cmd.Process.Pid, cmd.ProcessState)
 	}
-}
-
-func ExecutePipes(command []string) {
-	commands := splitPipes(command)
-	var cmds []*exec.Cmd
-	var prevPipeReader *os.File = nil
-	var wg sync.WaitGroup
-
-	for idx, val := range commands {
-		var currPipeReader *os.File = nil
-        var currPipeWriter *os.File = nil
-		if idx < len(commands) - 1 {
-            r, w, err := os.Pipe()
-			if err != nil {
-				log.Fatal(err)
-			}
-            currPipeReader = r
-            currPipeWriter = w
-        }
-		shouldCloseWriter := false
-
-		if builtin[val[0]] {
-			wg.Add(1)
-			go func(v []string, w *os.File) {
-				defer wg.Done()
-				builtinInPipe(v, w)
-			}(val, currPipeWriter)
-		} else {
-			cmd := exec.Command(val[0], val[1:]...)
-
-			if prevPipeReader != nil {
-				cmd.Stdin = prevPipeReader
-			} else {
-				cmd.Stdin = os.Stdin
-			}
-			if currPipeWriter != nil {
-				cmd.Stdout = currPipeWriter
-				shouldCloseWriter = true
-			} else {
-				cmd.Stdout = os.Stdout
-			}
-			cmd.Stderr = os.Stderr
-			cmd.Start()
-			cmds = append(cmds, cmd)
-		}
-
-		if shouldCloseWriter && currPipeWriter != nil {
-			currPipeWriter.Close()
-		}
-		if prevPipeReader != nil {
-			prevPipeReader.Close()
-		}        
-		prevPipeReader = currPipeReader
+	if cmd.ProcessState == nil {
+		fmt.Fprintf(std.err, "gosh: %s: %s\n", command[0], errorText(unwrapPathError(err)))
+		lastStatus = 126
+		return
 	}
-
-	for _, cmd := range cmds {
-		cmd.Wait()
+	lastStatus = exitStatus(cmd.ProcessState)
+	if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && status.Signaled() && std.job == nil {
+		reportSignal(cmd.Process.Pid, status, command)
 	}
-	wg.Wait()
 }
 
-func builtinInPipe(command []string, out *os.File) {
-	var cmdOutput string
-	switch command[0] {
-	case "echo" : cmdOutput = Echo(command)
-	case "pwd" : cmdOutput = Pwd()
-	case "cd" : cmdOutput = Cd(command)
-	case "type" : cmdOutput = Type(command)
-	case "history" : cmdOutput = History(command)
-	default : log.Fatal("Internal builtin code broken!")
-	}
-
-	if out != nil {
-		out.WriteString(cmdOutput)
-		out.Close()
-	} else {
-		fmt.Print(cmdOutput)
+// exitStatus is the status of a finished process as $? shows it, which
+// is 128 plus the signal for one that a signal killed.
+func exitStatus(state *os.ProcessState) int {
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
 	}
+	return state.ExitCode()
 }
 
-func splitPipes(command []string) (commands [][]string) {
-	var commandSet []string
-	for _, val := range command {
-		if val == "|" {
-			commands = append(commands, commandSet)
-			commandSet = nil		
-		} else {
-			commandSet = append(commandSet, val)
-		}
-	}
-	if commandSet != nil {
-		commands = append(commands, commandSet)
+// reportSignal says which signal killed a command run in the foreground,
+// except for an interrupt the user typed or a pipe whose reader went away.
+func reportSignal(pid int, status syscall.WaitStatus, command []string) {
+	sig := status.Signal()
+	if sig == syscall.SIGINT || sig == syscall.SIGPIPE {
+		return
 	}
-	return
-}
-
-func hasPipelines(command []string) bool {
-	for _, val := range command {
-		if val == "|" {
-			return true
-		}
+	core := ""
+	if status.CoreDump() {
+		core = " (core dumped)"
 	}
-	return false
+	fmt.Fprintf(os.Stderr, "gosh: %d %s%s  %s\n", pid, signalDescription(sig), core, strings.Join(command, " "))
 }
 
 func Welcome() {
@@ -672,8 +863,34 @@ func Welcome() {
     fmt.Println()
 }
 
+// interactive is set when gosh reads commands from the terminal, and
+// loginShell when it was started as a login shell, with a leading - in its
+// name or with -l.
+var interactive, loginShell bool
+
 func main() {
+	initPwd()
+	args := os.Args[1:]
+	loginShell = strings.HasPrefix(os.Args[0], "-")
+	if len(args) > 0 && (args[0] == "-l" || args[0] == "--login") {
+		loginShell = true
+		args = args[1:]
+	}
+	if len(args) == 2 && args[0] == "--subshell" {
+		os.Exit(runSubshellProcess(args[1]))
+	}
+	if len(args) > 0 {
+		os.Exit(runScript(args[0], args[1:]))
+	}
+	os.Exit(runInteractive())
+}
 
+// runInteractive reads and runs commands until exit or end of input, and
+// returns the status the shell exits with once history has been saved.
+func runInteractive() int {
+	interactive = true
+	shoptOptions["expand_aliases"] = true
+	catchHangup()
 	historyPath := getHistoryPath()
 	completer := readline.NewPrefixCompleter(initCompleters()...)
 	customCompleter := &bellCompleter{
@@ -682,72 +899,188 @@ func main() {
 
 	Welcome()
 
+	// readline takes 0 to mean its default, and a negative limit to mean
+	// no history at all.
+	readlineLimit := histSize()
+	switch readlineLimit {
+	case -1:
+		readlineLimit = math.MaxInt32
+	case 0:
+		readlineLimit = -1
+	}
+
+	prompt := "\033[36m\u276f \033[0m"
 	rl, err := readline.NewEx(&readline.Config{
-		Prompt:            "\033[36m\u276f \033[0m",
-		AutoComplete:      customCompleter,
-		InterruptPrompt:   "^C",
-		EOFPrompt:         "exit",
-		HistorySearchFold: true,
+		HistoryLimit:           readlineLimit,
+		Prompt:                 prompt,
+		AutoComplete:           customCompleter,
+		InterruptPrompt:        "^C",
+		EOFPrompt:              "exit",
+		HistorySearchFold:      true,
+		DisableAutoSaveHistory: true,
 	})
 	if err != nil {
-		log.Fatal(err)
+		fmt.Fprintf(os.Stderr, "gosh: %s\n", err)
+		return 1
 	}
 	defer rl.Close()
+	// Closing readline is what wakes the main loop when a SIGHUP arrives
+	// while it waits at the prompt.
+	go func() {
+		for range hangupWake {
+			rl.Close()
+		}
+	}()
 
-	if content, err := os.ReadFile(historyPath); err == nil {
-        lines := strings.Split(string(content), "\n")
-        for _, line := range lines {
-            if line != "" {
-				currHistoryInit++
-                rl.SaveHistory(line)
-            }
-        }
-    }
+	lineReader = rl
+	unlock := lockHistory(historyPath, false)
+	entries, _, err := readHistoryTail(historyPath, histSize())
+	if err == nil {
+		savedHistory = entries
+		currHistoryInit += len(entries)
+		for _, entry := range entries {
+			rl.SaveHistory(entry.text)
+		}
+	}
+	markHistoryRead(historyPath, entries)
+	unlock()
 	defer saveToHistory()
 
+	var source, historyEntry string
 	for {
+		if source == "" {
+			runPendingTraps(shellStdio())
+			reportJobs()
+			if shoptOptions["share_history"] {
+				readNewHistory()
+			}
+		}
 
 		rawCommand, err := rl.Readline()
+		if hangupPending.Load() {
+			hangup()
+		}
 		if err == readline.ErrInterrupt { // Ctrl + C
-			if len(rawCommand) == 0 {
+			if source != "" {
+				source, historyEntry = "", ""
+				rl.SetPrompt(prompt)
+				continue
+			} else if len(rawCommand) == 0 {
 				break
 			} else {
 				continue
 			}
 		} else if err == io.EOF { // Ctrl + D and other errs
+			if source != "" {
+				_, parseErr := parse(source)
+				fmt.Fprintf(os.Stderr, "gosh: %s\n", asSyntaxError(parseErr, source, 1))
+				lastStatus = 2
+			}
 			break
 		} else if err != nil { // Other rare errors! Something broke!!
 			break
 		}
 
-		command := commandParser(rawCommand)
+		if shellOptions["verbose"] {
+			fmt.Fprintln(os.Stderr, rawCommand)
+		}
+		source += rawCommand
+		cmd, parseErr := parse(source)
+		if incomplete, ok := parseErr.(*incompleteError); ok {
+			historyEntry = joinHistoryLine(historyEntry, rawCommand, incomplete)
+			if incomplete.backslash {
+				source = source[:len(source)-1]
+			} else {
+				source += "\n"
+			}
+			rl.SetPrompt(ps2())
+			continue
+		}
+		historyEntry += rawCommand
+		rl.SetPrompt(prompt)
 
-		if len(command) == 0 {
+		if strings.TrimSpace(historyEntry) != "" {
+			recordHistory(rl, historyEntry)
+		}
+		historyEntry = ""
+		if syntaxErr := asSyntaxError(parseErr, source, 1); syntaxErr != nil {
+			fmt.Fprintf(os.Stderr, "gosh: %s\n%s", syntaxErr, syntaxErr.caret(source, 1))
+			source = ""
+			lastStatus = 2
 			continue
 		}
-		appendToCurrHistory(rawCommand)
-		checkForEnvs(&command)
+		source = ""
 
-		if command[0] == "exit" {
+		if exitWarning > 0 {
+			exitWarning--
+		}
+		execNode(cmd, shellStdio())
+		if mainControl.exit {
 			break
-		} else if hasPipelines(command) {
-			ExecutePipes(command) 
-		} else if command[0] == "echo" {
-			fmt.Print(Echo(command))
-		} else if command[0] == "type" {
-			fmt.Print(Type(command))
-		} else if command[0] == "pwd" {
-			fmt.Print(Pwd())
-		} else if command[0] == "cd" {
-			fmt.Print(Cd(command))
-		} else if command[0] == "history" {
-			fmt.Print(History(command))
-		} else if command[0] == "welcome" {
-			Welcome()
-		} else if isExec(command) {
-			RunExec(command)
-		} else {
-			fmt.Println(command[0] + ": command not found")
 		}
 	}
+	if shoptOptions["huponexit"] {
+		hangupJobs()
+	}
+	runExitTrap()
+	return lastStatus
+}
+
+func ps2() string {
+	if prompt, set := os.LookupEnv("PS2"); set {
+		return prompt
+	}
+	return "> "
+}
+
+// joinHistoryLine adds a line that left the command incomplete to its
+// history entry, so a command typed over several lines is saved as one.
+func joinHistoryLine(entry string, line string, incomplete *incompleteError) string {
+	switch {
+	case incomplete.backslash:
+		return entry + line[:len(line)-1]
+	case incomplete.inQuote:
+		return entry + line + "\n"
+	}
+	trimmed := strings.TrimSpace(line)
+	for _, suffix := range []string{"|", "&&", "||", ";", "&", "(", "{", "then", "do", "else"} {
+		if trimmed == "" || strings.HasSuffix(trimmed, suffix) {
+			return entry + line + " "
+		}
+	}
+	return entry + line + "; "
+}
+
+func runCommand(command []string, std stdio) int {
+	if def, ok := functions[command[0]]; ok {
+		return callFunction(def.body, command, std)
+	}
+	return runUtility(command, std)
+}
+
+// runUtility runs command as a builtin or from PATH, passing over
+// functions, as the command builtin does.
+func runUtility(command []string, std stdio) int {
+	if builtins[command[0]] != nil {
+		lastStatus = runBuiltin(command, std)
+	} else if path, found := lookupCommand(command[0]); found {
+		RunExec(command, path, std)
+	} else if strings.Contains(command[0], "/") {
+		info, err := os.Stat(command[0])
+		switch {
+		case err != nil:
+			fmt.Fprintf(std.err, "gosh: %s: No such file or directory\n", command[0])
+			lastStatus = 127
+		case info.IsDir():
+			fmt.Fprintf(std.err, "gosh: %s: Is a directory\n", command[0])
+			lastStatus = 126
+		default:
+			fmt.Fprintf(std.err, "gosh: %s: Permission denied\n", command[0])
+			lastStatus = 126
+		}
+	} else {
+		fmt.Fprintln(std.err, command[0] + ": command not found")
+		lastStatus = 127
+	}
+	return lastStatus
 }
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The test binary runs as gosh itself when GOSH_TEST_MAIN is set, so that
+// scripts, and the subshells they start, run the code under test.
+func TestMain(m *testing.M) {
+	if os.Getenv("GOSH_TEST_MAIN") != "" {
+		main()
+	}
+	os.Exit(m.Run())
+}
+
+// runGosh runs script as a gosh script file and returns what it wrote to
+// stdout and stderr and the status it exited with.
+func runGosh(t *testing.T, script string) (stdout, stderr string, status int) {
+	t.Helper()
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "script.sh")
+	if err := os.WriteFile(path, []byte(script), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(self, path)
+	cmd.Dir = t.TempDir()
+	cmd.Env = append(os.Environ(), "GOSH_TEST_MAIN=1")
+	out, errOut := new(strings.Builder), new(strings.Builder)
+	cmd.Stdout, cmd.Stderr = out, errOut
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		status = exitErr.ExitCode()
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return out.String(), errOut.String(), status
+}
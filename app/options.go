@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// optionNames lists the options known to set -o in the order they are
+// listed, and optionLetters maps the single letter flags onto them.
+var optionNames = []string{"errexit", "noclobber", "noglob", "nounset", "pipefail", "verbose", "xtrace"}
+
+var optionLetters = map[byte]string{
+	'e': "errexit",
+	'u': "nounset",
+	'x': "xtrace",
+	'C': "noclobber",
+	'f': "noglob",
+	'v': "verbose",
+}
+
+var shellOptions = map[string]bool{}
+
+// optionFlags returns the letters of the options that are on, for $-.
+func optionFlags() string {
+	var flags []byte
+	for letter, name := range optionLetters {
+		if shellOptions[name] {
+			flags = append(flags, letter)
+		}
+	}
+	slices.Sort(flags)
+	return string(flags)
+}
+
+func Set(command []string, std streams) int {
+	if len(command) == 1 {
+		names := make([]string, 0, 64)
+		values := make(map[string]string, 64)
+		for _, kv := range os.Environ() {
+			if eq := strings.IndexByte(kv, '='); eq > 0 {
+				names = append(names, kv[:eq])
+				values[kv[:eq]] = kv[eq+1:]
+			}
+		}
+		slices.Sort(names)
+		var output strings.Builder
+		for _, name := range names {
+			fmt.Fprintf(&output, "%s=%s\n", name, quoteIfNeeded(values[name]))
+		}
+		return std.print("set", output.String())
+	}
+
+	args := command[1:]
+	for len(args) > 0 {
+		arg := args[0]
+		if arg == "--" {
+			positionalParams = arrayFromList(args[1:])
+			return 0
+		}
+		if arg == "-" {
+			shellOptions["xtrace"] = false
+			shellOptions["verbose"] = false
+			args = args[1:]
+			continue
+		}
+		if len(arg) < 2 || (arg[0] != '-' && arg[0] != '+') {
+			positionalParams = arrayFromList(args)
+			return 0
+		}
+		enable := arg[0] == '-'
+		args = args[1:]
+		for i := 1; i < len(arg); i++ {
+			if arg[i] == 'o' {
+				if len(args) == 0 {
+					return std.print("set", listOptions(enable))
+				}
+				name := args[0]
+				args = args[1:]
+				if !slices.Contains(optionNames, name) {
+					fmt.Fprintf(std.err, "set: %s: invalid option name\n", name)
+					return 2
+				}
+				shellOptions[name] = enable
+				continue
+			}
+			name, ok := optionLetters[arg[i]]
+			if !ok {
+				fmt.Fprintf(std.err, "set: %c%c: invalid option\n", arg[0], arg[i])
+				return 2
+			}
+			shellOptions[name] = enable
+		}
+	}
+	return 0
+}
+
+// listOptions prints the options as a table for set -o, or as the set
+// commands that would restore them for set +o.
+func listOptions(table bool) string {
+	var output strings.Builder
+	for _, name := range optionNames {
+		if table {
+			state := "off"
+			if shellOptions[name] {
+				state = "on"
+			}
+			fmt.Fprintf(&output, "%-15s\t%s\n", name, state)
+		} else if shellOptions[name] {
+			fmt.Fprintf(&output, "set -o %s\n", name)
+		} else {
+			fmt.Fprintf(&output, "set +o %s\n", name)
+		}
+	}
+	return output.String()
+}
+
+// shoptNames lists the options shopt sets, which keep their own names
+// apart from those of set -o.
+var shoptNames = []string{"expand_aliases", "huponexit", "inc_append_history", "share_history"}
+
+var shoptOptions = map[string]bool{}
+
+func Shopt(command []string, std streams) int {
+	args := command[1:]
+	var set, unset, quiet, reusable bool
+	for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+		arg := args[0]
+		args = args[1:]
+		if arg == "--" {
+			break
+		}
+		for _, flag := range arg[1:] {
+			switch flag {
+			case 's':
+				set = true
+			case 'u':
+				unset = true
+			case 'q':
+				quiet = true
+			case 'p':
+				reusable = true
+			default:
+				fmt.Fprintf(std.err, "gosh: shopt: -%c: invalid option\n", flag)
+				fmt.Fprintln(std.err, "shopt: usage: shopt [-pqsu] [optname ...]")
+				return 2
+			}
+		}
+	}
+	if set && unset {
+		fmt.Fprintln(std.err, "gosh: shopt: cannot set and unset shell options simultaneously")
+		return 1
+	}
+
+	names := args
+	if len(names) == 0 {
+		names = shoptNames
+		if set || unset {
+			// shopt -s alone lists the options that are on, -u those off.
+			names = slices.DeleteFunc(slices.Clone(names), func(name string) bool {
+				return shoptOptions[name] != set
+			})
+			set, unset = false, false
+		}
+	}
+
+	var output strings.Builder
+	status := 0
+	for _, name := range names {
+		if !slices.Contains(shoptNames, name) {
+			fmt.Fprintf(std.err, "gosh: shopt: %s: invalid shell option name\n", name)
+			status = 1
+			continue
+		}
+		switch {
+		case set || unset:
+			shoptOptions[name] = set
+		case !shoptOptions[name]:
+			status = 1
+			fallthrough
+		default:
+			if quiet {
+				continue
+			}
+			flag, state := "-u", "off"
+			if shoptOptions[name] {
+				flag, state = "-s", "on"
+			}
+			if reusable {
+				fmt.Fprintf(&output, "shopt %s %s\n", flag, name)
+			} else {
+				fmt.Fprintf(&output, "%-15s\t%s\n", name, state)
+			}
+		}
+	}
+	if std.print("shopt", output.String()) != 0 {
+		return 1
+	}
+	if len(args) == 0 {
+		return 0
+	}
+	return status
+}
+
+// quoteIfNeeded quotes s for display only when it contains characters the
+// shell would treat specially.
+func quoteIfNeeded(s string) string {
+	if s == "" {
+		return "''"
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte("_@%+=:,./-", c) != -1) {
+			if strings.ContainsAny(s, "\n\t\r\033") {
+				return shellQuote(s)
+			}
+			return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+		}
+	}
+	return s
+}
+
+// xtrace prints a traced command on stderr, prefixed by PS4.
+func xtrace(assigns []assignment, command []string, declared []assignment) {
+	prefix, set := os.LookupEnv("PS4")
+	if !set {
+		prefix = "+ "
+	}
+	words := assignmentStrings(assigns)
+	for _, arg := range command {
+		words = append(words, quoteIfNeeded(arg))
+	}
+	words = append(words, assignmentStrings(declared)...)
+	fmt.Fprintln(os.Stderr, prefix+strings.Join(words, " "))
+}
+
+func assignmentStrings(assigns []assignment) (strs []string) {
+	for _, a := range assigns {
+		strs = append(strs, a.String())
+	}
+	return
+}
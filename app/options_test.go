@@ -0,0 +1,14 @@
+package main
+
+import "testing"
+
+func TestNounsetExitsScript(t *testing.T) {
+	stdout, stderr, status := runGosh(t, `set -u
+echo a
+echo "$unset_variable"
+echo b
+`)
+	if stdout != "a\n" || stderr != "gosh: unset_variable: unbound variable\n" || status != 1 {
+		t.Errorf("got %q, %q, status %d; want \"a\\n\", an unbound variable error and status 1", stdout, stderr, status)
+	}
+}
@@ -0,0 +1,927 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+type wordPart struct {
+	text  string
+	quote byte // 0, '\'', '"', or '\\' for a backslash-escaped character
+}
+
+type word []wordPart
+
+type tokenKind int
+
+const (
+	tokWord tokenKind = iota
+	tokOp
+	tokNewline
+	tokEOF
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	word word
+	pos  int
+	ends bool // a newline the parser found ending a command, as ';' would
+}
+
+var operators = []string{"&&", "||", ";;", "&>>", ">>", ">|", "<&", ">&", "<>", "&>", "|", "&", ";", "(", ")", "<", ">"}
+
+var reservedWords = map[string]bool{
+	"if": true, "then": true, "elif": true, "else": true, "fi": true,
+	"while": true, "until": true, "do": true, "done": true,
+	"for": true, "in": true, "function": true, "{": true, "}": true, "!": true,
+	"time": true, "coproc": true, "[[": true, "]]": true,
+}
+
+type node interface{}
+
+type redirect struct {
+	fd     int
+	op     string
+	target word
+	pos    int
+}
+
+type simpleCmd struct {
+	assigns []word
+	args    []word
+	redirs  []redirect
+	pos     int
+}
+
+type pipeline struct {
+	cmds   []node
+	texts  []string // the words of each command, for the subshells they run in
+	negate bool
+	timed  bool
+	posix  bool // time -p
+	pos    int
+}
+
+type andOrList struct {
+	first node
+	ops   []string
+	rest  []node
+}
+
+type cmdList struct {
+	cmds  []node
+	async []bool
+	texts []string // the words of each command, for the job table
+}
+
+type braceGroup struct {
+	body   node
+	redirs []redirect
+}
+
+type subshell struct {
+	body   node
+	redirs []redirect
+}
+
+// coproc runs body in the background with pipes to its standard input
+// and output, which the shell reaches through the array called name.
+type coproc struct {
+	name string
+	text string // the command, which runs in a subshell of its own
+}
+
+type ifClause struct {
+	conds    []node
+	bodies   []node
+	elseBody node
+	redirs   []redirect
+}
+
+type loopClause struct {
+	until  bool
+	cond   node
+	body   node
+	redirs []redirect
+}
+
+type forClause struct {
+	name   string
+	items  []word
+	hasIn  bool
+	body   node
+	redirs []redirect
+}
+
+type funcDef struct {
+	name string
+	body node
+	text string // the whole definition, for the subshells of pipelines
+}
+
+// incompleteError is returned when the input ends in the middle of a
+// statement, so the caller can read another line and try again.
+type incompleteError struct {
+	inQuote   bool
+	backslash bool
+	lastToken string
+}
+
+func (e *incompleteError) Error() string {
+	return "syntax error: unexpected end of file"
+}
+
+// syntaxError describes input that can never form a valid command. An
+// empty token means the input ended where more was required.
+type syntaxError struct {
+	token  string
+	pos    int
+	file   string
+	line   int
+	column int
+}
+
+func (e *syntaxError) Error() string {
+	location := fmt.Sprintf("line %d: ", e.line)
+	if e.file != "" {
+		location = e.file + ": " + location
+	}
+	if e.token == "" {
+		return location + "syntax error: unexpected end of file"
+	}
+	return location + fmt.Sprintf("syntax error near unexpected token '%s'", e.token)
+}
+
+// locate fills in the line and column of e within source, counting lines
+// from firstLine.
+func (e *syntaxError) locate(source string, firstLine int) {
+	pos := min(e.pos, len(source))
+	e.line = firstLine + strings.Count(source[:pos], "\n")
+	e.column = pos - strings.LastIndexByte(source[:pos], '\n')
+}
+
+// caret returns the line of source holding the error with a caret marking
+// the column, for showing under an interactive command.
+func (e *syntaxError) caret(source string, firstLine int) string {
+	lines := strings.Split(source, "\n")
+	index := e.line - firstLine
+	if index < 0 || index >= len(lines) {
+		return ""
+	}
+	line := lines[index]
+	var marker strings.Builder
+	for i := 0; i < e.column-1 && i < len(line); i++ {
+		if line[i] == '\t' {
+			marker.WriteByte('\t')
+		} else {
+			marker.WriteByte(' ')
+		}
+	}
+	marker.WriteByte('^')
+	return line + "\n" + marker.String() + "\n"
+}
+
+// asSyntaxError turns err from parse into a located *syntaxError, treating
+// an incomplete command as an unexpected end of file.
+func asSyntaxError(err error, source string, firstLine int) *syntaxError {
+	switch err := err.(type) {
+	case *syntaxError:
+		err.locate(source, firstLine)
+		return err
+	case *incompleteError:
+		e := &syntaxError{pos: len(source)}
+		e.locate(source, firstLine)
+		return e
+	}
+	return nil
+}
+
+func isBlank(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\f' || c == '\v'
+}
+
+func isOperatorStart(c byte) bool {
+	return strings.IndexByte("|&;<>()", c) != -1
+}
+
+// commandParser splits rawCommand into words and operators, keeping track of
+// which parts of each word were quoted.
+func commandParser(rawCommand string) (tokens []token, err error) {
+	i := 0
+	for {
+		for i < len(rawCommand) {
+			if isBlank(rawCommand[i]) {
+				i++
+			} else if rawCommand[i] == '\\' && i+1 < len(rawCommand) && rawCommand[i+1] == '\n' {
+				if i+2 == len(rawCommand) {
+					err = &incompleteError{backslash: true}
+					return
+				}
+				i += 2
+			} else {
+				break
+			}
+		}
+		if i >= len(rawCommand) {
+			tokens = append(tokens, token{kind: tokEOF, pos: i})
+			return
+		}
+
+		c := rawCommand[i]
+		switch {
+		case c == '\n':
+			tokens = append(tokens, token{kind: tokNewline, text: "newline", pos: i})
+			i++
+		case c == '#':
+			for i < len(rawCommand) && rawCommand[i] != '\n' {
+				i++
+			}
+		case isOperatorStart(c):
+			op := lexOperator(rawCommand[i:])
+			tokens = append(tokens, token{kind: tokOp, text: op, pos: i})
+			i += len(op)
+		default:
+			start := i
+			var w word
+			w, i, err = lexWord(rawCommand, i)
+			if err != nil {
+				return
+			}
+			text := rawCommand[start:i]
+			if i < len(rawCommand) && (rawCommand[i] == '<' || rawCommand[i] == '>') && len(w) == 1 && w[0].quote == 0 && isDigits(w[0].text) {
+				op := lexOperator(rawCommand[i:])
+				tokens = append(tokens, token{kind: tokOp, text: text + op, pos: start})
+				i += len(op)
+				continue
+			}
+			tokens = append(tokens, token{kind: tokWord, text: text, word: w, pos: start})
+		}
+	}
+}
+
+func lexOperator(s string) string {
+	for _, op := range operators {
+		if strings.HasPrefix(s, op) {
+			return op
+		}
+	}
+	return s[:1]
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// lexWord reads one word starting at rawCommand[i] and returns it with the
+// index just past its end.
+func lexWord(rawCommand string, i int) (word, int, error) {
+	var current word
+	var temp strings.Builder
+
+	endPart := func(quote byte) {
+		if temp.Len() > 0 || quote != 0 {
+			current = append(current, wordPart{temp.String(), quote})
+			temp.Reset()
+		}
+	}
+	// copySubst copies a $(...), ${...} or `...` starting at rawCommand[i]
+	// into the current part, returning the index of its last byte.
+	copySubst := func(i int) (int, error) {
+		var end int
+		switch {
+		case rawCommand[i] == '`':
+			end = matchBacktick(rawCommand, i)
+			if rawCommand[end] != '`' || end == i {
+				return 0, &incompleteError{inQuote: true}
+			}
+		case rawCommand[i+1] == '(':
+			end = matchParen(rawCommand, i+1)
+			if rawCommand[end] != ')' {
+				return 0, &incompleteError{lastToken: "("}
+			}
+		default:
+			end = matchBrace(rawCommand, i+1)
+			if end == -1 {
+				return 0, &incompleteError{inQuote: true}
+			}
+		}
+		temp.WriteString(rawCommand[i : end+1])
+		return end, nil
+	}
+
+	for ; i < len(rawCommand); i++ {
+		c := rawCommand[i]
+		if c == '(' && len(current) == 0 && isArrayAssignmentPrefix(temp.String()) {
+			end := matchParen(rawCommand, i)
+			if rawCommand[end] != ')' {
+				return nil, i, &incompleteError{lastToken: "("}
+			}
+			temp.WriteString(rawCommand[i : end+1])
+			i = end
+			continue
+		}
+		if isBlank(c) || c == '\n' || isOperatorStart(c) {
+			break
+		}
+		switch c {
+		case '\'':
+			endPart(0)
+			end := strings.IndexByte(rawCommand[i+1:], '\'')
+			if end == -1 {
+				return nil, i, &incompleteError{inQuote: true}
+			}
+			temp.WriteString(rawCommand[i+1 : i+1+end])
+			endPart('\'')
+			i += end + 1
+		case '"':
+			endPart(0)
+			i++
+			for ; i < len(rawCommand) && rawCommand[i] != '"'; i++ {
+				switch rawCommand[i] {
+				case '\\':
+					if i+1 < len(rawCommand) && rawCommand[i+1] == '\n' {
+						i++
+						continue
+					}
+					if i+1 < len(rawCommand) && strings.IndexByte("\"\\`$", rawCommand[i+1]) != -1 {
+						endPart('"')
+						temp.WriteByte(rawCommand[i+1])
+						endPart('\\')
+						i++
+						continue
+					}
+					temp.WriteByte(rawCommand[i])
+				case '$', '`':
+					if rawCommand[i] == '$' && (i+1 >= len(rawCommand) || (rawCommand[i+1] != '(' && rawCommand[i+1] != '{')) {
+						temp.WriteByte(rawCommand[i])
+						continue
+					}
+					end, err := copySubst(i)
+					if err != nil {
+						return nil, i, &incompleteError{inQuote: true}
+					}
+					i = end
+				default:
+					temp.WriteByte(rawCommand[i])
+				}
+			}
+			if i >= len(rawCommand) {
+				return nil, i, &incompleteError{inQuote: true}
+			}
+			endPart('"')
+		case '\\':
+			if i+1 >= len(rawCommand) {
+				return nil, i, &incompleteError{backslash: true}
+			}
+			if rawCommand[i+1] == '\n' {
+				if i+2 == len(rawCommand) {
+					return nil, i, &incompleteError{backslash: true}
+				}
+				i++
+				continue
+			}
+			endPart(0)
+			temp.WriteByte(rawCommand[i+1])
+			endPart('\\')
+			i++
+		case '$', '`':
+			if c == '$' && i+1 < len(rawCommand) && rawCommand[i+1] == '\'' {
+				endPart(0)
+				end, err := lexANSIQuote(rawCommand, i+2, &temp)
+				if err != nil {
+					return nil, i, err
+				}
+				endPart('\'')
+				i = end
+				continue
+			}
+			if c == '$' && (i+1 >= len(rawCommand) || (rawCommand[i+1] != '(' && rawCommand[i+1] != '{')) {
+				temp.WriteByte(c)
+				continue
+			}
+			end, err := copySubst(i)
+			if err != nil {
+				return nil, i, err
+			}
+			i = end
+		default:
+			temp.WriteByte(c)
+		}
+	}
+	endPart(0)
+	return current, i, nil
+}
+
+// lexANSIQuote decodes the escapes of a $'...' string whose text starts
+// at rawCommand[i] into output, returning the index of the closing quote.
+func lexANSIQuote(rawCommand string, i int, output *strings.Builder) (int, error) {
+	for ; i < len(rawCommand); i++ {
+		switch c := rawCommand[i]; {
+		case c == '\'':
+			return i, nil
+		case c != '\\':
+			output.WriteByte(c)
+		case i+2 < len(rawCommand) && rawCommand[i+1] == 'c':
+			output.WriteByte(rawCommand[i+2] & 0x1f)
+			i += 2
+		default:
+			n, _ := parseEscape(rawCommand[i:], output, false)
+			i += n - 1
+		}
+	}
+	return 0, &incompleteError{inQuote: true}
+}
+
+// isArrayAssignmentPrefix reports whether s is a NAME= or NAME+= that may
+// be followed by a parenthesised list of array elements.
+func isArrayAssignmentPrefix(s string) bool {
+	name, found := strings.CutSuffix(s, "=")
+	return found && isValidName(strings.TrimSuffix(name, "+"))
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// parse turns source into a command tree. It returns an *incompleteError
+// when source stops in the middle of a statement.
+func parse(source string) (node, error) {
+	tokens, err := commandParser(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	list, err := p.parseList(nil)
+	if err == nil && p.peek().kind != tokEOF {
+		err = p.unexpected(p.peek())
+	}
+	if e, ok := err.(*syntaxError); ok {
+		e.locate(source, 1)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// isReserved reports whether tok is the reserved word name. Reserved words
+// are only recognised unquoted and in command position, which is where the
+// parser calls this.
+func isReserved(tok token, name string) bool {
+	return tok.kind == tokWord && len(tok.word) == 1 && tok.word[0].quote == 0 && tok.text == name
+}
+
+func (p *parser) isOp(text string) bool {
+	tok := p.peek()
+	return tok.kind == tokOp && tok.text == text
+}
+
+func (p *parser) unexpected(tok token) error {
+	if tok.kind == tokEOF {
+		lastToken := ""
+		if p.pos > 0 {
+			lastToken = p.tokens[p.pos-1].text
+		}
+		return &incompleteError{lastToken: lastToken}
+	}
+	return &syntaxError{token: tok.text, pos: tok.pos}
+}
+
+// unexpectedWord is used where a word must follow on the same line, so
+// reaching the end of the input is an error rather than a reason to wait
+// for more.
+func (p *parser) unexpectedWord(tok token) error {
+	if tok.kind == tokEOF {
+		return &syntaxError{token: "newline", pos: tok.pos}
+	}
+	return p.unexpected(tok)
+}
+
+func (p *parser) skipNewlines() {
+	for p.peek().kind == tokNewline {
+		p.next()
+	}
+}
+
+func (p *parser) expectReserved(name string) error {
+	p.skipNewlines()
+	tok := p.peek()
+	if !isReserved(tok, name) {
+		return p.unexpected(tok)
+	}
+	p.next()
+	return nil
+}
+
+// parseList reads and-or lists separated by ';', '&' or newlines until it
+// reaches EOF, a ')' or one of the reserved words in terminators.
+func (p *parser) parseList(terminators []string) (*cmdList, error) {
+	list := &cmdList{}
+	for {
+		p.skipNewlines()
+		tok := p.peek()
+		if tok.kind == tokEOF {
+			if terminators != nil {
+				return nil, p.unexpected(tok)
+			}
+			return list, nil
+		}
+		if tok.kind == tokOp && tok.text == ")" {
+			break
+		}
+		if tok.kind == tokWord && slices.Contains(terminators, tok.text) && isReserved(tok, tok.text) {
+			break
+		}
+
+		start := p.pos
+		cmd, err := p.parseAndOr()
+		if err != nil {
+			return nil, err
+		}
+		text := p.textFrom(start)
+		async := false
+		if p.isOp("&") {
+			async = true
+			p.next()
+		} else if p.isOp(";") {
+			p.next()
+		} else if tok := p.peek(); tok.kind == tokNewline {
+			p.tokens[p.pos].ends = true
+		} else if tok.kind != tokEOF && !(tok.kind == tokOp && tok.text == ")") && !(tok.kind == tokWord && slices.Contains(terminators, tok.text)) {
+			return nil, p.unexpected(tok)
+		}
+		list.cmds = append(list.cmds, cmd)
+		list.async = append(list.async, async)
+		list.texts = append(list.texts, text)
+	}
+	if len(list.cmds) == 0 {
+		return nil, p.unexpected(p.peek())
+	}
+	return list, nil
+}
+
+// textFrom joins the tokens read since start back into a command line.
+// A newline that ends a command becomes ';', and the others, such as
+// those after '{', do or '|', are dropped.
+func (p *parser) textFrom(start int) string {
+	var words []string
+	for _, tok := range p.tokens[start:p.pos] {
+		if tok.kind == tokNewline {
+			if tok.ends && len(words) > 0 && words[len(words)-1] != ";" {
+				words = append(words, ";")
+			}
+			continue
+		}
+		words = append(words, tok.text)
+	}
+	return strings.Join(words, " ")
+}
+
+// parseBody reads a list that must be closed by one of terminators, leaving
+// the closing reserved word as the next token.
+func (p *parser) parseBody(terminators ...string) (*cmdList, error) {
+	list, err := p.parseList(terminators)
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); !slices.ContainsFunc(terminators, func(name string) bool { return isReserved(tok, name) }) {
+		return nil, p.unexpected(tok)
+	}
+	return list, nil
+}
+
+func (p *parser) parseAndOr() (node, error) {
+	first, err := p.parsePipeline()
+	if err != nil {
+		return nil, err
+	}
+	andOr := &andOrList{first: first}
+	for p.isOp("&&") || p.isOp("||") {
+		op := p.next().text
+		p.skipNewlines()
+		cmd, err := p.parsePipeline()
+		if err != nil {
+			return nil, err
+		}
+		andOr.ops = append(andOr.ops, op)
+		andOr.rest = append(andOr.rest, cmd)
+	}
+	if len(andOr.ops) == 0 {
+		return first, nil
+	}
+	return andOr, nil
+}
+
+func (p *parser) parsePipeline() (node, error) {
+	pipe := &pipeline{pos: p.peek().pos}
+	if isReserved(p.peek(), "time") {
+		pipe.timed = true
+		p.next()
+		if tok := p.peek(); tok.kind == tokWord && tok.text == "-p" {
+			pipe.posix = true
+			p.next()
+		}
+	}
+	if isReserved(p.peek(), "!") {
+		pipe.negate = true
+		p.next()
+	}
+	if tok := p.peek(); pipe.timed && !pipe.negate && (tok.kind == tokNewline || tok.kind == tokEOF ||
+		tok.kind == tokOp && tok.text != "(" && tok.text != "<" && tok.text != ">") {
+		// time on its own times nothing, and reports the shell's total.
+		return pipe, nil
+	}
+	for {
+		start := p.pos
+		cmd, err := p.parseCommand()
+		if err != nil {
+			return nil, err
+		}
+		pipe.cmds = append(pipe.cmds, cmd)
+		pipe.texts = append(pipe.texts, p.textFrom(start))
+		if !p.isOp("|") {
+			break
+		}
+		p.next()
+		p.skipNewlines()
+	}
+	if len(pipe.cmds) == 1 && !pipe.negate && !pipe.timed {
+		return pipe.cmds[0], nil
+	}
+	return pipe, nil
+}
+
+func (p *parser) parseCommand() (node, error) {
+	p.expandAlias()
+	start := p.pos
+	tok := p.peek()
+	if tok.kind == tokOp && tok.text == "(" {
+		p.next()
+		body, err := p.parseList([]string{})
+		if err != nil {
+			return nil, err
+		}
+		if !p.isOp(")") {
+			return nil, p.unexpected(p.peek())
+		}
+		p.next()
+		cmd := &subshell{body: body}
+		cmd.redirs, err = p.parseRedirects()
+		return cmd, err
+	}
+	if tok.kind != tokWord {
+		return nil, p.unexpected(tok)
+	}
+
+	switch {
+	case isReserved(tok, "{"):
+		p.next()
+		body, err := p.parseBody("}")
+		if err != nil {
+			return nil, err
+		}
+		p.next()
+		cmd := &braceGroup{body: body}
+		cmd.redirs, err = p.parseRedirects()
+		return cmd, err
+	case isReserved(tok, "if"):
+		return p.parseIf()
+	case isReserved(tok, "while"), isReserved(tok, "until"):
+		p.next()
+		cond, err := p.parseBody("do")
+		if err != nil {
+			return nil, err
+		}
+		p.next()
+		body, err := p.parseBody("done")
+		if err != nil {
+			return nil, err
+		}
+		p.next()
+		cmd := &loopClause{until: tok.text == "until", cond: cond, body: body}
+		cmd.redirs, err = p.parseRedirects()
+		return cmd, err
+	case isReserved(tok, "for"):
+		return p.parseFor()
+	case isReserved(tok, "function"):
+		p.next()
+		name := p.next()
+		if name.kind != tokWord || !isValidName(name.text) {
+			return nil, p.unexpectedWord(name)
+		}
+		if p.isOp("(") {
+			p.next()
+			if !p.isOp(")") {
+				return nil, p.unexpected(p.peek())
+			}
+			p.next()
+		}
+		return p.parseFuncBody(name.text, start)
+	case isReserved(tok, "coproc"):
+		return p.parseCoproc()
+	case isReserved(tok, "[["):
+		return p.parseCond()
+	case tok.kind == tokWord && reservedWords[tok.text] && isReserved(tok, tok.text) && tok.text != "!" && tok.text != "time":
+		return nil, p.unexpected(tok)
+	}
+
+	if p.pos+2 < len(p.tokens) && p.tokens[p.pos+1].kind == tokOp && p.tokens[p.pos+1].text == "(" && isValidName(tok.text) {
+		p.next()
+		p.next()
+		if !p.isOp(")") {
+			return nil, p.unexpected(p.peek())
+		}
+		p.next()
+		return p.parseFuncBody(tok.text, start)
+	}
+	return p.parseSimple()
+}
+
+// parseCoproc reads coproc [NAME] command. A name is only taken when a
+// compound command follows it, since otherwise it is the command itself.
+func (p *parser) parseCoproc() (node, error) {
+	p.next()
+	cmd := &coproc{name: "COPROC"}
+	if tok := p.peek(); tok.kind == tokWord && isValidName(tok.text) && p.pos+1 < len(p.tokens) {
+		next := p.tokens[p.pos+1]
+		if next.kind == tokOp && next.text == "(" || next.kind == tokWord &&
+			slices.ContainsFunc([]string{"{", "if", "while", "until", "for"}, func(word string) bool { return isReserved(next, word) }) {
+			cmd.name = tok.text
+			p.next()
+		}
+	}
+	start := p.pos
+	if _, err := p.parseCommand(); err != nil {
+		return nil, err
+	}
+	cmd.text = p.textFrom(start)
+	return cmd, nil
+}
+
+// parseFuncBody reads the body of a function whose definition began with
+// the token at start.
+func (p *parser) parseFuncBody(name string, start int) (node, error) {
+	p.skipNewlines()
+	body, err := p.parseCommand()
+	if err != nil {
+		return nil, err
+	}
+	switch body.(type) {
+	case *braceGroup, *subshell, *ifClause, *loopClause, *forClause, *condCmd:
+	default:
+		return nil, &syntaxError{token: p.tokens[p.pos-1].text, pos: p.tokens[p.pos-1].pos}
+	}
+	return &funcDef{name: name, body: body, text: p.textFrom(start)}, nil
+}
+
+func (p *parser) parseIf() (node, error) {
+	cmd := &ifClause{}
+	p.next()
+	for {
+		cond, err := p.parseBody("then")
+		if err != nil {
+			return nil, err
+		}
+		p.next()
+		body, err := p.parseBody("elif", "else", "fi")
+		if err != nil {
+			return nil, err
+		}
+		cmd.conds = append(cmd.conds, cond)
+		cmd.bodies = append(cmd.bodies, body)
+
+		switch p.next().text {
+		case "elif":
+			continue
+		case "else":
+			cmd.elseBody, err = p.parseBody("fi")
+			if err != nil {
+				return nil, err
+			}
+			p.next()
+		}
+		cmd.redirs, err = p.parseRedirects()
+		return cmd, err
+	}
+}
+
+func (p *parser) parseFor() (node, error) {
+	p.next()
+	name := p.next()
+	if name.kind != tokWord || !isValidName(name.text) {
+		return nil, p.unexpectedWord(name)
+	}
+	cmd := &forClause{name: name.text}
+	p.skipNewlines()
+	if isReserved(p.peek(), "in") {
+		p.next()
+		cmd.hasIn = true
+		for p.peek().kind == tokWord {
+			cmd.items = append(cmd.items, p.next().word)
+		}
+		if p.isOp(";") {
+			p.next()
+		} else if tok := p.peek(); tok.kind == tokNewline {
+			p.tokens[p.pos].ends = true
+		} else {
+			return nil, p.unexpected(tok)
+		}
+	} else if p.isOp(";") {
+		p.next()
+	}
+	if err := p.expectReserved("do"); err != nil {
+		return nil, err
+	}
+	body, err := p.parseBody("done")
+	if err != nil {
+		return nil, err
+	}
+	p.next()
+	cmd.body = body
+	cmd.redirs, err = p.parseRedirects()
+	return cmd, err
+}
+
+func isRedirectOp(tok token) bool {
+	if tok.kind != tokOp {
+		return false
+	}
+	op := strings.TrimLeft(tok.text, "0123456789")
+	return strings.ContainsAny(op, "<>")
+}
+
+func (p *parser) parseRedirect() (redirect, error) {
+	tok := p.next()
+	op := strings.TrimLeft(tok.text, "0123456789")
+	r := redirect{fd: -1, op: op, pos: tok.pos}
+	if digits := tok.text[:len(tok.text)-len(op)]; digits != "" {
+		fmt.Sscan(digits, &r.fd)
+	}
+	target := p.peek()
+	if target.kind != tokWord {
+		return r, p.unexpectedWord(target)
+	}
+	r.target = p.next().word
+	return r, nil
+}
+
+func (p *parser) parseRedirects() (redirs []redirect, err error) {
+	for isRedirectOp(p.peek()) {
+		r, err := p.parseRedirect()
+		if err != nil {
+			return nil, err
+		}
+		redirs = append(redirs, r)
+	}
+	return
+}
+
+func (p *parser) parseSimple() (node, error) {
+	cmd := &simpleCmd{pos: p.peek().pos}
+	for {
+		tok := p.peek()
+		if isRedirectOp(tok) {
+			r, err := p.parseRedirect()
+			if err != nil {
+				return nil, err
+			}
+			cmd.redirs = append(cmd.redirs, r)
+		} else if tok.kind == tokWord {
+			p.next()
+			if len(cmd.args) == 0 && isAssignment(tok.word) {
+				cmd.assigns = append(cmd.assigns, tok.word)
+			} else {
+				cmd.args = append(cmd.args, tok.word)
+			}
+		} else {
+			break
+		}
+	}
+	if len(cmd.args) == 0 && len(cmd.assigns) == 0 && len(cmd.redirs) == 0 {
+		return nil, p.unexpected(p.peek())
+	}
+	return cmd, nil
+}
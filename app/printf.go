@@ -0,0 +1,378 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+func Printf(command []string, std streams) int {
+	args := command[1:]
+	varName := ""
+	if len(args) > 1 && args[0] == "-v" {
+		varName = args[1]
+		if !isValidName(varName) {
+			fmt.Fprintf(std.err, "gosh: printf: `%s': not a valid identifier\n", varName)
+			return 1
+		}
+		args = args[2:]
+	}
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		fmt.Fprintln(std.err, "printf: usage: printf [-v var] format [arguments]")
+		return 2
+	}
+
+	format := args[0]
+	args = args[1:]
+	p := printer{err: std.err}
+	for {
+		consumed, stop := p.formatOnce(format, args)
+		args = args[consumed:]
+		if stop || consumed == 0 || len(args) == 0 {
+			break
+		}
+	}
+
+	if varName != "" {
+		setVar(varName, p.output.String())
+		return p.status
+	}
+	if status := std.print("printf", p.output.String()); status != 0 {
+		return status
+	}
+	return p.status
+}
+
+// printer collects the output of printf. A bad format or argument is
+// reported on err and makes the status 1, but what output there is still
+// gets printed.
+type printer struct {
+	output strings.Builder
+	err    io.Writer
+	status int
+}
+
+func (p *printer) invalid(format string, args ...any) {
+	fmt.Fprintf(p.err, format, args...)
+	p.status = 1
+}
+
+// formatOnce expands format a single time, reporting how many arguments
+// it used and whether a \c escape asked for all output to stop.
+func (p *printer) formatOnce(format string, args []string) (consumed int, stop bool) {
+	output := &p.output
+	nextArg := func() (string, bool) {
+		if consumed < len(args) {
+			consumed++
+			return args[consumed-1], true
+		}
+		return "", false
+	}
+
+	for i := 0; i < len(format); i++ {
+		switch format[i] {
+		case '\\':
+			n, s := parseEscape(format[i:], output, false)
+			if s {
+				return consumed, true
+			}
+			i += n - 1
+		case '%':
+			if i+1 < len(format) && format[i+1] == '%' {
+				output.WriteByte('%')
+				i++
+				continue
+			}
+			j := i + 1
+			for j < len(format) && strings.IndexByte("-+ #0", format[j]) != -1 {
+				j++
+			}
+			flags := format[i+1 : j]
+			width := ""
+			if j < len(format) && format[j] == '*' {
+				arg, _ := nextArg()
+				width = strconv.FormatInt(p.parseNumber(arg), 10)
+				j++
+			} else {
+				start := j
+				for j < len(format) && format[j] >= '0' && format[j] <= '9' {
+					j++
+				}
+				width = format[start:j]
+			}
+			precision := ""
+			if j < len(format) && format[j] == '.' {
+				j++
+				if j < len(format) && format[j] == '*' {
+					arg, _ := nextArg()
+					precision = "." + strconv.FormatInt(p.parseNumber(arg), 10)
+					j++
+				} else {
+					start := j
+					for j < len(format) && format[j] >= '0' && format[j] <= '9' {
+						j++
+					}
+					precision = "." + format[start:j]
+				}
+			}
+			if j >= len(format) {
+				p.invalid("gosh: printf: `%s': missing format character\n", format[i:])
+				return consumed, true
+			}
+			spec := "%" + flags + width + precision
+			arg, _ := nextArg()
+			switch verb := format[j]; verb {
+			case 'd', 'i':
+				fmt.Fprintf(output, spec+"d", p.parseNumber(arg))
+			case 'u':
+				fmt.Fprintf(output, spec+"d", uint64(p.parseNumber(arg)))
+			case 'x', 'X', 'o':
+				fmt.Fprintf(output, spec+string(verb), uint64(p.parseNumber(arg)))
+			case 'f', 'F', 'e', 'E', 'g', 'G':
+				fmt.Fprintf(output, spec+string(verb), p.parseFloat(arg))
+			case 'c':
+				_, size := utf8.DecodeRuneInString(arg)
+				arg = arg[:size]
+				fmt.Fprintf(output, "%"+flags+width+"s", arg)
+			case 's':
+				fmt.Fprintf(output, spec+"s", arg)
+			case 'b':
+				var expanded strings.Builder
+				s := expandEscapes(arg, &expanded, true)
+				fmt.Fprintf(output, spec+"s", expanded.String())
+				if s {
+					return consumed, true
+				}
+			case 'q':
+				fmt.Fprintf(output, "%"+flags+width+"s", shellQuote(arg))
+			default:
+				p.invalid("gosh: printf: `%c': invalid format character\n", verb)
+				return consumed, true
+			}
+			i = j
+		default:
+			output.WriteByte(format[i])
+		}
+	}
+	return consumed, false
+}
+
+// parseNumber reads a printf integer argument: decimal, 0x hex, leading 0
+// octal, or 'c / "c for the character code of c.
+func (p *printer) parseNumber(arg string) int64 {
+	arg = strings.TrimSpace(arg)
+	if arg == "" {
+		return 0
+	}
+	if arg[0] == '\'' || arg[0] == '"' {
+		if len(arg) == 1 {
+			return 0
+		}
+		r, _ := utf8.DecodeRuneInString(arg[1:])
+		return int64(r)
+	}
+	val, err := strconv.ParseInt(arg, 0, 64)
+	if err != nil {
+		if uval, uerr := strconv.ParseUint(arg, 0, 64); uerr == nil {
+			return int64(uval)
+		}
+		p.invalid("gosh: printf: %s: invalid number\n", arg)
+		return 0
+	}
+	return val
+}
+
+func (p *printer) parseFloat(arg string) float64 {
+	arg = strings.TrimSpace(arg)
+	if arg == "" {
+		return 0
+	}
+	if arg[0] == '\'' || arg[0] == '"' {
+		return float64(p.parseNumber(arg))
+	}
+	val, err := strconv.ParseFloat(arg, 64)
+	if err != nil {
+		p.invalid("gosh: printf: %s: invalid number\n", arg)
+		return 0
+	}
+	return val
+}
+
+// expandEscapes writes s to output with backslash escapes interpreted, as
+// done by echo -e and printf %b. It returns true when \c was seen.
+func expandEscapes(s string, output *strings.Builder, octalNeedsZero bool) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			output.WriteByte(s[i])
+			continue
+		}
+		n, stop := parseEscape(s[i:], output, octalNeedsZero)
+		if stop {
+			return true
+		}
+		i += n - 1
+	}
+	return false
+}
+
+// parseEscape decodes the escape sequence at the start of s, writing the
+// result to output. It returns the number of bytes consumed. In echo -e and
+// %b octal escapes are written \0nnn, in printf formats \nnn.
+func parseEscape(s string, output *strings.Builder, octalNeedsZero bool) (int, bool) {
+	if len(s) < 2 {
+		output.WriteByte('\\')
+		return 1, false
+	}
+	switch s[1] {
+	case 'a':
+		output.WriteByte('\a')
+	case 'b':
+		output.WriteByte('\b')
+	case 'c':
+		return 2, true
+	case 'e', 'E':
+		output.WriteByte('\033')
+	case 'f':
+		output.WriteByte('\f')
+	case 'n':
+		output.WriteByte('\n')
+	case 'r':
+		output.WriteByte('\r')
+	case 't':
+		output.WriteByte('\t')
+	case 'v':
+		output.WriteByte('\v')
+	case '\\':
+		output.WriteByte('\\')
+	case '"':
+		output.WriteByte('"')
+	case '\'':
+		output.WriteByte('\'')
+	case 'x':
+		n := countDigits(s[2:], 2, 16)
+		if n == 0 {
+			output.WriteString(s[:2])
+			return 2, false
+		}
+		val, _ := strconv.ParseUint(s[2:2+n], 16, 8)
+		output.WriteByte(byte(val))
+		return 2 + n, false
+	case 'u', 'U':
+		maxDigits := 4
+		if s[1] == 'U' {
+			maxDigits = 8
+		}
+		n := countDigits(s[2:], maxDigits, 16)
+		if n == 0 {
+			output.WriteString(s[:2])
+			return 2, false
+		}
+		val, _ := strconv.ParseUint(s[2:2+n], 16, 32)
+		output.WriteRune(rune(val))
+		return 2 + n, false
+	default:
+		start := 1
+		if octalNeedsZero {
+			if s[1] != '0' {
+				output.WriteString(s[:2])
+				return 2, false
+			}
+			start = 2
+		}
+		n := countDigits(s[start:], 3, 8)
+		if n == 0 {
+			if octalNeedsZero {
+				output.WriteByte(0)
+				return 2, false
+			}
+			output.WriteString(s[:2])
+			return 2, false
+		}
+		val, _ := strconv.ParseUint(s[start:start+n], 8, 16)
+		output.WriteByte(byte(val))
+		return start + n, false
+	}
+	return 2, false
+}
+
+func countDigits(s string, maxDigits int, base int) (n int) {
+	for n < len(s) && n < maxDigits {
+		c := s[n]
+		isDigit := c >= '0' && c <= '7'
+		if base == 16 {
+			isDigit = (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+		}
+		if !isDigit {
+			break
+		}
+		n++
+	}
+	return
+}
+
+// shellQuote returns s quoted so that gosh would read it back as one word.
+func shellQuote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	printable := true
+	for _, r := range s {
+		if r < ' ' || r == 0x7f {
+			printable = false
+			break
+		}
+	}
+	if !printable {
+		var quoted strings.Builder
+		quoted.WriteString("$'")
+		for i := 0; i < len(s); i++ {
+			switch c := s[i]; c {
+			case '\n':
+				quoted.WriteString(`\n`)
+			case '\t':
+				quoted.WriteString(`\t`)
+			case '\r':
+				quoted.WriteString(`\r`)
+			case '\033':
+				quoted.WriteString(`\E`)
+			case '\\', '\'':
+				quoted.WriteByte('\\')
+				quoted.WriteByte(c)
+			default:
+				if c < ' ' || c == 0x7f {
+					fmt.Fprintf(&quoted, `\%03o`, c)
+				} else {
+					quoted.WriteByte(c)
+				}
+			}
+		}
+		quoted.WriteByte('\'')
+		return quoted.String()
+	}
+	var quoted strings.Builder
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte(" \t|&;()<>{}[]$`\\\"'*?!#~=%^,", s[i]) != -1 {
+			quoted.WriteByte('\\')
+		}
+		quoted.WriteByte(s[i])
+	}
+	return quoted.String()
+}
+
+func isValidName(name string) bool {
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !(c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')) {
+			return false
+		}
+	}
+	return true
+}
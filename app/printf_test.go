@@ -0,0 +1,14 @@
+package main
+
+import "testing"
+
+func TestPrintfQuoteReadsBack(t *testing.T) {
+	stdout, stderr, _ := runGosh(t, `s=$'a b\n\tit'"'"'s \\ \001'
+eval "t=$(printf %q "$s")"
+[ "$s" = "$t" ] && echo same
+printf '%c\n' é
+`)
+	if want := "same\né\n"; stdout != want {
+		t.Errorf("got %q, want %q (stderr %q)", stdout, want, stderr)
+	}
+}
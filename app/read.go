@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Read reads a line and splits it on IFS into the named variables, the
+// last one taking whatever is left, or stores it whole in REPLY. It reads
+// one byte at a time so that nothing after the line is taken from a pipe
+// another command will read next.
+func Read(command []string, std streams) int {
+	args := command[1:]
+	raw := false
+	prompt, arrayName := "", ""
+	delim := byte('\n')
+	input := std.in
+	for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+		arg := args[0]
+		args = args[1:]
+		if arg == "--" {
+			break
+		}
+		for i := 1; i < len(arg); i++ {
+			flag := arg[i]
+			if flag == 'r' {
+				raw = true
+				continue
+			}
+			if strings.IndexByte("adpu", flag) < 0 {
+				fmt.Fprintf(std.err, "gosh: read: -%c: invalid option\n", flag)
+				fmt.Fprintln(std.err, "read: usage: read [-r] [-a array] [-d delim] [-p prompt] [-u fd] [name ...]")
+				return 2
+			}
+			// The rest of the argument, or the next one, is the option's
+			// value.
+			value := arg[i+1:]
+			if value == "" {
+				if len(args) == 0 {
+					fmt.Fprintf(std.err, "gosh: read: -%c: option requires an argument\n", flag)
+					return 2
+				}
+				value, args = args[0], args[1:]
+			}
+			switch flag {
+			case 'a':
+				arrayName = value
+			case 'd':
+				delim = 0
+				if value != "" {
+					delim = value[0]
+				}
+			case 'p':
+				prompt = value
+			case 'u':
+				fd, err := strconv.Atoi(value)
+				file, open := std.files.file(fd)
+				if err != nil || !open {
+					fmt.Fprintf(std.err, "gosh: read: %s: invalid file descriptor specification\n", value)
+					return 1
+				}
+				input = file
+			}
+			break
+		}
+	}
+	for _, name := range append(args, arrayName) {
+		if name != "" && !isValidName(name) {
+			fmt.Fprintf(std.err, "gosh: read: `%s': not a valid identifier\n", name)
+			return 1
+		}
+	}
+
+	if file, ok := input.(*os.File); ok && prompt != "" {
+		if _, err := unix.IoctlGetTermios(int(file.Fd()), unix.TCGETS); err == nil {
+			io.WriteString(std.err, prompt)
+		}
+	}
+
+	// escaped marks the bytes a backslash protected from splitting.
+	var line []byte
+	var escaped []bool
+	status := 0
+	buf := make([]byte, 1)
+	for {
+		n, err := input.Read(buf)
+		if n == 0 {
+			if err != nil && err != io.EOF {
+				fmt.Fprintf(std.err, "gosh: read: read error: %s\n", errorText(unwrapPathError(err)))
+			}
+			status = 1
+			break
+		}
+		c := buf[0]
+		if c == delim {
+			break
+		}
+		if c == '\\' && !raw {
+			if n, _ := input.Read(buf); n == 0 {
+				status = 1
+				break
+			}
+			if buf[0] == '\n' {
+				continue
+			}
+			line, escaped = append(line, buf[0]), append(escaped, true)
+			continue
+		}
+		line, escaped = append(line, c), append(escaped, false)
+	}
+
+	ifs, set := os.LookupEnv("IFS")
+	if !set {
+		ifs = " \t\n"
+	}
+	switch {
+	case arrayName != "":
+		setArray(arrayName, arrayFromList(splitRead(line, escaped, ifs, -1)))
+	case len(args) == 0:
+		setVar("REPLY", string(line))
+	default:
+		fields := splitRead(line, escaped, ifs, len(args))
+		for i, name := range args {
+			value := ""
+			if i < len(fields) {
+				value = fields[i]
+			}
+			setVar(name, value)
+		}
+	}
+	return status
+}
+
+// splitRead splits line into at most n fields on the characters of ifs,
+// with the last field keeping the rest of the line; n < 0 means no limit.
+// Whitespace in ifs is trimmed from both ends and runs of it count as one
+// separator.
+func splitRead(line []byte, escaped []bool, ifs string, n int) []string {
+	isSep := func(i int) bool { return !escaped[i] && strings.IndexByte(ifs, line[i]) >= 0 }
+	isSpace := func(i int) bool { return isSep(i) && strings.IndexByte(" \t\n", line[i]) >= 0 }
+
+	start, end := 0, len(line)
+	for start < end && isSpace(start) {
+		start++
+	}
+	for end > start && isSpace(end-1) {
+		end--
+	}
+	var fields []string
+	i := start
+	for i < end {
+		if n >= 0 && len(fields) == n-1 {
+			fields = append(fields, string(line[i:end]))
+			return fields
+		}
+		j := i
+		for j < end && !isSep(j) {
+			j++
+		}
+		fields = append(fields, string(line[i:j]))
+		// Skip the separator: surrounding whitespace and at most one
+		// other IFS character.
+		for j < end && isSpace(j) {
+			j++
+		}
+		if j < end && isSep(j) && !isSpace(j) {
+			j++
+			for j < end && isSpace(j) {
+				j++
+			}
+		}
+		i = j
+	}
+	return fields
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+// shellName is $0: "gosh" interactively, or the path of the script.
+var shellName = "gosh"
+
+// shellPid is $$, which a subshell keeps from the shell that started it.
+var shellPid = os.Getpid()
+
+// runScript runs the commands in the file at path with args as the
+// positional parameters, one complete command at a time, so that the
+// commands before a syntax error still run.
+func runScript(path string, args []string) int {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		err = unwrapPathError(err)
+		fmt.Fprintf(os.Stderr, "gosh: %s: %s\n", path, errorText(err))
+		if errors.Is(err, fs.ErrNotExist) {
+			return 127
+		}
+		return 126
+	}
+	shellName = path
+	positionalParams = arrayFromList(args)
+
+	lines := strings.SplitAfter(string(content), "\n")
+	source, firstLine := "", 1
+	for i, line := range lines {
+		source += line
+		cmd, parseErr := parse(source)
+		if incomplete, ok := parseErr.(*incompleteError); ok {
+			if i < len(lines)-1 {
+				continue
+			}
+			if incomplete.backslash {
+				cmd, parseErr = parse(strings.TrimSuffix(source, "\\\n"))
+			}
+		}
+		if shellOptions["verbose"] {
+			fmt.Fprint(os.Stderr, source)
+		}
+		if syntaxErr := asSyntaxError(parseErr, source, firstLine); syntaxErr != nil {
+			syntaxErr.file = path
+			fmt.Fprintf(os.Stderr, "gosh: %s\n", syntaxErr)
+			return 2
+		}
+		source, firstLine = "", i+2
+
+		execNode(cmd, shellStdio())
+		if mainControl.exit {
+			break
+		}
+	}
+	runExitTrap()
+	return lastStatus
+}
+
+// errorText turns a system error into the capitalised form shells print,
+// such as "No such file or directory".
+func errorText(err error) string {
+	text := err.Error()
+	if text == "" {
+		return text
+	}
+	return strings.ToUpper(text[:1]) + text[1:]
+}
+
+// unwrapPathError drops the operation and path from a *fs.PathError, for
+// messages that name the file themselves.
+func unwrapPathError(err error) error {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		return pathErr.Err
+	}
+	return err
+}
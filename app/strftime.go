@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// strftime formats t with the C strftime conversions that shell formats
+// such as HISTTIMEFORMAT use. Unknown conversions are copied as written.
+func strftime(format string, t time.Time) string {
+	var output strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i == len(format)-1 {
+			output.WriteByte(format[i])
+			continue
+		}
+		i++
+		switch format[i] {
+		case 'a':
+			output.WriteString(t.Format("Mon"))
+		case 'A':
+			output.WriteString(t.Format("Monday"))
+		case 'b', 'h':
+			output.WriteString(t.Format("Jan"))
+		case 'B':
+			output.WriteString(t.Format("January"))
+		case 'c':
+			output.WriteString(t.Format("Mon Jan _2 15:04:05 2006"))
+		case 'C':
+			fmt.Fprintf(&output, "%02d", t.Year()/100)
+		case 'd':
+			fmt.Fprintf(&output, "%02d", t.Day())
+		case 'D':
+			output.WriteString(t.Format("01/02/06"))
+		case 'e':
+			fmt.Fprintf(&output, "%2d", t.Day())
+		case 'F':
+			output.WriteString(t.Format("2006-01-02"))
+		case 'H':
+			fmt.Fprintf(&output, "%02d", t.Hour())
+		case 'I':
+			fmt.Fprintf(&output, "%02d", (t.Hour()+11)%12+1)
+		case 'j':
+			fmt.Fprintf(&output, "%03d", t.YearDay())
+		case 'k':
+			fmt.Fprintf(&output, "%2d", t.Hour())
+		case 'l':
+			fmt.Fprintf(&output, "%2d", (t.Hour()+11)%12+1)
+		case 'm':
+			fmt.Fprintf(&output, "%02d", int(t.Month()))
+		case 'M':
+			fmt.Fprintf(&output, "%02d", t.Minute())
+		case 'n':
+			output.WriteByte('\n')
+		case 'p':
+			output.WriteString(t.Format("PM"))
+		case 'r':
+			output.WriteString(t.Format("03:04:05 PM"))
+		case 'R':
+			output.WriteString(t.Format("15:04"))
+		case 's':
+			fmt.Fprintf(&output, "%d", t.Unix())
+		case 'S':
+			fmt.Fprintf(&output, "%02d", t.Second())
+		case 't':
+			output.WriteByte('\t')
+		case 'T', 'X':
+			output.WriteString(t.Format("15:04:05"))
+		case 'u':
+			fmt.Fprintf(&output, "%d", (int(t.Weekday())+6)%7+1)
+		case 'w':
+			fmt.Fprintf(&output, "%d", int(t.Weekday()))
+		case 'x':
+			output.WriteString(t.Format("01/02/06"))
+		case 'y':
+			fmt.Fprintf(&output, "%02d", t.Year()%100)
+		case 'Y':
+			fmt.Fprintf(&output, "%d", t.Year())
+		case 'z':
+			output.WriteString(t.Format("-0700"))
+		case 'Z':
+			output.WriteString(t.Format("MST"))
+		case '%':
+			output.WriteByte('%')
+		default:
+			output.WriteString(format[i-1 : i+1])
+		}
+	}
+	return output.String()
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// subshellState is what a subshell inherits from the shell besides its
+// environment, working directory and descriptors, which a new process
+// inherits anyway. Go cannot fork, so a subshell that must run alongside
+// the shell, as the commands of a pipeline do, is a new gosh process that
+// is handed this state and then runs its command.
+type subshellState struct {
+	// Setup sets the options, aliases, arrays and functions again, before
+	// Command runs.
+	Setup   string
+	Command string
+	Name    string
+	Params  []string
+	Pid     int
+	Status  int
+	LastPid int
+	Dirs    []string
+	Fds     []int // the descriptors above 2 that are open for commands
+	// History is the shell's history as a history file would keep it,
+	// with the number of its first entry, when Command may list it.
+	History      string
+	HistoryFirst int
+}
+
+// subshellSetup writes the shell's options, aliases, arrays and functions
+// as the commands that set them again.
+func subshellSetup() string {
+	var script strings.Builder
+	script.WriteString(listOptions(false))
+	for _, name := range shoptNames {
+		if shoptOptions[name] {
+			fmt.Fprintf(&script, "shopt -s %s\n", name)
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(aliases)) {
+		script.WriteString(aliasDefinition(name))
+	}
+	for _, name := range slices.Sorted(maps.Keys(snapshotArrays())) {
+		if decl, ok := declaration(name); ok {
+			script.WriteString(decl + "\n")
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(functions)) {
+		script.WriteString(functions[name].text + "\n")
+	}
+	return script.String()
+}
+
+// startSubshell starts text running in a subshell with the given streams
+// and returns the function that waits for it and gives its status. The
+// state goes to the new process through a pipe on the first descriptor
+// after those it inherits.
+func startSubshell(text string, std stdio) func() int {
+	failed := func(err error) func() int {
+		fmt.Fprintf(std.err, "gosh: %s\n", errorText(unwrapPathError(err)))
+		return func() int { return 126 }
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return failed(err)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return failed(err)
+	}
+
+	extra := std.extraFiles()
+	state := subshellState{
+		Setup:   subshellSetup(),
+		Command: text,
+		Name:    shellName,
+		Params:  positionalParams.list(),
+		Pid:     shellPid,
+		Status:  lastStatus,
+		LastPid: lastPid,
+		Dirs:    dirStack,
+	}
+	// The history can be long, so it is only sent to a subshell whose
+	// command, or a function it may call, names the history builtin.
+	if strings.Contains(text, "history") || strings.Contains(state.Setup, "history") {
+		var history strings.Builder
+		for _, entry := range allHistory() {
+			history.WriteString(entry.String())
+		}
+		state.History = history.String()
+		state.HistoryFirst = currHistoryInit - len(savedHistory)
+	}
+	for i, file := range extra {
+		if file != nil {
+			state.Fds = append(state.Fds, i+3)
+		}
+	}
+	stateFd := len(extra) + 3
+	cmd := &exec.Cmd{
+		Path:       self,
+		Args:       []string{"gosh", "--subshell", strconv.Itoa(stateFd)},
+		ExtraFiles: append(extra, r),
+	}
+	if std.in != nil {
+		cmd.Stdin = std.in
+	}
+	if std.out != nil {
+		cmd.Stdout = std.out
+	}
+	if std.err != nil {
+		cmd.Stderr = std.err
+	}
+	cmd, err = std.startProcess(cmd)
+	r.Close()
+	if err != nil {
+		w.Close()
+		if errors.Is(err, errJobKilled) {
+			return func() int { return 128 + int(std.job.stop.Load()) }
+		}
+		return failed(err)
+	}
+	json.NewEncoder(w).Encode(state)
+	w.Close()
+
+	return func() int {
+		cmd.Wait()
+		addChildUsage(cmd.ProcessState)
+		std.processExited(cmd.Process.Pid, cmd.ProcessState)
+		return exitStatus(cmd.ProcessState)
+	}
+}
+
+// runSubshellProcess is the subshell side of startSubshell: it takes on
+// the state read from the descriptor fd and runs the command.
+func runSubshellProcess(fd string) int {
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gosh: --subshell: %s: bad file descriptor\n", fd)
+		return 2
+	}
+	file := os.NewFile(uintptr(n), "subshell state")
+	var state subshellState
+	err = json.NewDecoder(file).Decode(&state)
+	file.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gosh: --subshell: %s\n", err)
+		return 2
+	}
+
+	shellName, shellPid = state.Name, state.Pid
+	lastStatus, lastPid = state.Status, state.LastPid
+	positionalParams = arrayFromList(state.Params)
+	dirStack = state.Dirs
+	if state.History != "" {
+		savedHistory = parseHistory(state.History)
+		currHistoryInit = state.HistoryFirst + len(savedHistory)
+	}
+	for _, fd := range state.Fds {
+		shellFds[fd] = os.NewFile(uintptr(fd), "/dev/fd/"+strconv.Itoa(fd))
+	}
+
+	// Both are parsed before either runs, so that the aliases the setup
+	// defines are not expanded again in a command the shell has already
+	// expanded them in.
+	setup, err := parse(state.Setup)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gosh: %s\n", asSyntaxError(err, state.Setup, 1))
+		return 2
+	}
+	cmd, err := parse(state.Command)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gosh: %s\n", asSyntaxError(err, state.Command, 1))
+		return 2
+	}
+	execNode(setup, shellStdio())
+	lastStatus = state.Status
+	execNode(cmd, shellStdio())
+	runExitTrap()
+	return lastStatus
+}
@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestPipelineAfterMultiLineFunction(t *testing.T) {
+	stdout, stderr, status := runGosh(t, `f() {
+	for i in 1 2
+	do
+		echo "$i"
+	done |
+		cat
+}
+echo x | cat
+f | cat
+`)
+	if want := "x\n1\n2\n"; stdout != want || stderr != "" || status != 0 {
+		t.Errorf("got %q, %q, status %d; want %q", stdout, stderr, status, want)
+	}
+}
+
+func TestPipelineDoesNotChangeShell(t *testing.T) {
+	stdout, _, _ := runGosh(t, `cd /tmp
+x=1
+echo | { cd /; x=2; }
+echo "$PWD $x"
+`)
+	if want := "/tmp 1\n"; stdout != want {
+		t.Errorf("got %q, want %q", stdout, want)
+	}
+}
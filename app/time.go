@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// childUsage totals the user and system CPU time of every process the
+// shell has waited for.
+var (
+	childUser, childSys time.Duration
+	childUsageMu        sync.Mutex
+	shellStart          = time.Now()
+)
+
+// addChildUsage adds the CPU time of a finished process to the totals.
+func addChildUsage(state *os.ProcessState) {
+	if state == nil {
+		return
+	}
+	childUsageMu.Lock()
+	defer childUsageMu.Unlock()
+	if usage, ok := state.SysUsage().(*syscall.Rusage); ok {
+		childUser += time.Duration(usage.Utime.Nano())
+		childSys += time.Duration(usage.Stime.Nano())
+	}
+}
+
+// cpuTimes returns the CPU time used by the shell itself and by the
+// children it has waited for.
+func cpuTimes() (user, sys, cUser, cSys time.Duration) {
+	var self syscall.Rusage
+	if syscall.Getrusage(syscall.RUSAGE_SELF, &self) == nil {
+		user = time.Duration(self.Utime.Nano())
+		sys = time.Duration(self.Stime.Nano())
+	}
+	childUsageMu.Lock()
+	defer childUsageMu.Unlock()
+	return user, sys, childUser, childSys
+}
+
+// timePipeline runs a pipeline preceded by time and reports how long it
+// took. A time with no pipeline reports the time since the shell started.
+func timePipeline(p *pipeline, std stdio) int {
+	start := time.Now()
+	user, sys, cUser, cSys := cpuTimes()
+	status := 0
+	if len(p.cmds) > 0 {
+		status = ExecutePipes(p, std)
+	} else {
+		start, user, sys, cUser, cSys = shellStart, 0, 0, 0, 0
+	}
+	real := time.Since(start)
+	user2, sys2, cUser2, cSys2 := cpuTimes()
+	userTotal := user2 - user + cUser2 - cUser
+	sysTotal := sys2 - sys + cSys2 - cSys
+
+	format, set := os.LookupEnv("TIMEFORMAT")
+	if !set {
+		format = "\nreal\t%3lR\nuser\t%3lU\nsys\t%3lS"
+	}
+	if p.posix {
+		format = "real %2R\nuser %2U\nsys %2S"
+	}
+	if format != "" && std.err != nil {
+		io.WriteString(std.err, formatTimes(format, real, userTotal, sysTotal)+"\n")
+	}
+	return status
+}
+
+// formatTimes expands the % escapes of TIMEFORMAT: %[p][l]R, U and S for
+// the real, user and system time with p decimal places, optionally as
+// minutes and seconds, %P for the CPU percentage and %% for a %.
+func formatTimes(format string, real, user, sys time.Duration) string {
+	var output strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i == len(format)-1 {
+			output.WriteByte(format[i])
+			continue
+		}
+		i++
+		if format[i] == '%' {
+			output.WriteByte('%')
+			continue
+		}
+		if format[i] == 'P' {
+			percent := 0.0
+			if real > 0 {
+				percent = float64(user+sys) * 100 / float64(real)
+			}
+			fmt.Fprintf(&output, "%.2f", percent)
+			continue
+		}
+		start := i - 1
+		precision := 3
+		if format[i] >= '0' && format[i] <= '9' {
+			precision = min(int(format[i]-'0'), 3)
+			i++
+		}
+		long := false
+		if i < len(format) && format[i] == 'l' {
+			long = true
+			i++
+		}
+		var d time.Duration
+		switch {
+		case i < len(format) && format[i] == 'R':
+			d = real
+		case i < len(format) && format[i] == 'U':
+			d = user
+		case i < len(format) && format[i] == 'S':
+			d = sys
+		default:
+			// Not an escape time knows: leave it as it was written.
+			i = min(i, len(format)-1)
+			output.WriteString(format[start : i+1])
+			continue
+		}
+		output.WriteString(formatDuration(d, precision, long))
+	}
+	return output.String()
+}
+
+// formatDuration writes d as seconds with the given number of decimal
+// places, or in the long form as minutes and seconds, like 1m2.345s.
+func formatDuration(d time.Duration, precision int, long bool) string {
+	seconds := d.Seconds()
+	if !long {
+		return fmt.Sprintf("%.*f", precision, seconds)
+	}
+	minutes := int(seconds / 60)
+	return fmt.Sprintf("%dm%.*fs", minutes, precision, seconds-float64(minutes*60))
+}
+
+func Times(command []string, std streams) int {
+	user, sys, cUser, cSys := cpuTimes()
+	return std.print("times", fmt.Sprintf("%s %s\n%s %s\n",
+		formatDuration(user, 3, true), formatDuration(sys, 3, true),
+		formatDuration(cUser, 3, true), formatDuration(cSys, 3, true)))
+}
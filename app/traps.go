@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// signalNames lists the signals gosh knows by name, in number order.
+var signalNames = []struct {
+	name   string
+	signal syscall.Signal
+}{
+	{"HUP", syscall.SIGHUP}, {"INT", syscall.SIGINT}, {"QUIT", syscall.SIGQUIT},
+	{"ILL", syscall.SIGILL}, {"TRAP", syscall.SIGTRAP}, {"ABRT", syscall.SIGABRT},
+	{"BUS", syscall.SIGBUS}, {"FPE", syscall.SIGFPE}, {"KILL", syscall.SIGKILL},
+	{"USR1", syscall.SIGUSR1}, {"SEGV", syscall.SIGSEGV}, {"USR2", syscall.SIGUSR2},
+	{"PIPE", syscall.SIGPIPE}, {"ALRM", syscall.SIGALRM}, {"TERM", syscall.SIGTERM},
+	{"STKFLT", syscall.SIGSTKFLT}, {"CHLD", syscall.SIGCHLD}, {"CONT", syscall.SIGCONT},
+	{"STOP", syscall.SIGSTOP}, {"TSTP", syscall.SIGTSTP}, {"TTIN", syscall.SIGTTIN},
+	{"TTOU", syscall.SIGTTOU}, {"URG", syscall.SIGURG}, {"XCPU", syscall.SIGXCPU},
+	{"XFSZ", syscall.SIGXFSZ}, {"VTALRM", syscall.SIGVTALRM}, {"PROF", syscall.SIGPROF},
+	{"WINCH", syscall.SIGWINCH}, {"IO", syscall.SIGIO}, {"PWR", syscall.SIGPWR},
+	{"SYS", syscall.SIGSYS},
+}
+
+// parseSignal reads a signal given by number or by name, with or without
+// the SIG prefix and in any case.
+func parseSignal(spec string) (syscall.Signal, string, bool) {
+	if n, err := strconv.Atoi(spec); err == nil {
+		for _, s := range signalNames {
+			if int(s.signal) == n {
+				return s.signal, s.name, true
+			}
+		}
+		return 0, "", false
+	}
+	name := strings.TrimPrefix(strings.ToUpper(spec), "SIG")
+	for _, s := range signalNames {
+		if s.name == name {
+			return s.signal, s.name, true
+		}
+	}
+	return 0, "", false
+}
+
+// signalTable lists the signals with their numbers, as trap -l and kill
+// -l show them.
+func signalTable() string {
+	var output strings.Builder
+	for i, s := range signalNames {
+		fmt.Fprintf(&output, "%2d) SIG%-8s", s.signal, s.name)
+		if i%5 == 4 || i == len(signalNames)-1 {
+			output.WriteString("\n")
+		}
+	}
+	return output.String()
+}
+
+// signalDescription is how a signal is named when it has killed a job,
+// such as Terminated or Killed.
+func signalDescription(sig syscall.Signal) string {
+	text := sig.String()
+	return strings.ToUpper(text[:1]) + text[1:]
+}
+
+// traps maps EXIT and signal names to the commands trap set for them. An
+// empty command means the signal is ignored.
+var (
+	traps          = map[string]string{}
+	pendingSignals []string
+	trapsMu        sync.Mutex
+	signalCh       = make(chan os.Signal, 16)
+)
+
+// hangupPending is set when a SIGHUP with no trap arrives. The main loop
+// ends the shell when it next looks, between commands, and hangupWake
+// tells it to stop waiting at the prompt.
+var (
+	hangupPending atomic.Bool
+	hangupWake    = make(chan struct{}, 1)
+)
+
+func init() {
+	go func() {
+		for sig := range signalCh {
+			trapsMu.Lock()
+			_, trapped := traps["HUP"]
+			trapsMu.Unlock()
+			if sig == syscall.SIGHUP && !trapped {
+				hangupPending.Store(true)
+				select {
+				case hangupWake <- struct{}{}:
+				default:
+				}
+				continue
+			}
+			for _, s := range signalNames {
+				if s.signal == sig {
+					trapsMu.Lock()
+					pendingSignals = append(pendingSignals, s.name)
+					trapsMu.Unlock()
+				}
+			}
+		}
+	}()
+}
+
+// catchHangup makes an interactive shell pass SIGHUP on to its jobs
+// before it exits, as it does when its terminal goes away.
+func catchHangup() {
+	signal.Notify(signalCh, syscall.SIGHUP)
+}
+
+// hangup ends the shell on SIGHUP, first sending it to the jobs and
+// running the EXIT trap. It runs on the main goroutine, which owns the
+// history and the variables the EXIT trap may use.
+func hangup() {
+	hangupJobs()
+	runExitTrap()
+	saveToHistory()
+	os.Exit(128 + int(syscall.SIGHUP))
+}
+
+// runPendingTraps runs the trap commands of signals that arrived since it
+// was last called. They run between commands, never in the middle of one,
+// and leave $? as it was.
+func runPendingTraps(std stdio) {
+	if hangupPending.Load() {
+		hangup()
+	}
+	trapsMu.Lock()
+	pending := pendingSignals
+	pendingSignals = nil
+	trapsMu.Unlock()
+	for _, name := range pending {
+		trapsMu.Lock()
+		action := traps[name]
+		trapsMu.Unlock()
+		runTrap(action, std)
+	}
+}
+
+func runTrap(action string, std stdio) {
+	if action == "" {
+		return
+	}
+	cmd, err := parse(action)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gosh: trap: %s\n", asSyntaxError(err, action, 1))
+		return
+	}
+	status := lastStatus
+	execNode(cmd, std)
+	lastStatus = status
+}
+
+// runExitTrap runs the EXIT trap once, as the shell finishes.
+func runExitTrap() {
+	trapsMu.Lock()
+	action, ok := traps["EXIT"]
+	delete(traps, "EXIT")
+	trapsMu.Unlock()
+	if ok {
+		std := shellStdio()
+		std.ctl = &control{}
+		runTrap(action, std)
+	}
+}
+
+func Trap(command []string, std streams) int {
+	args := command[1:]
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+	if len(args) == 0 || args[0] == "-p" {
+		return std.print("trap", listTraps(args))
+	}
+	if args[0] == "-l" {
+		return std.print("trap", signalTable())
+	}
+
+	action, specs := args[0], args[1:]
+	reset := action == "-"
+	if len(specs) == 0 {
+		// A lone argument names a signal to put back to its default.
+		action, specs, reset = "-", args, true
+	} else if _, _, isSignal := parseSignal(action); isSignal || action == "EXIT" {
+		if isUnsignedNumber(action) {
+			action, specs, reset = "-", args, true
+		}
+	}
+
+	status := 0
+	for _, spec := range specs {
+		if spec == "0" || strings.ToUpper(spec) == "EXIT" {
+			trapsMu.Lock()
+			if reset {
+				delete(traps, "EXIT")
+			} else {
+				traps["EXIT"] = action
+			}
+			trapsMu.Unlock()
+			continue
+		}
+		sig, name, ok := parseSignal(spec)
+		if !ok || sig == syscall.SIGKILL || sig == syscall.SIGSTOP {
+			fmt.Fprintf(std.err, "gosh: trap: %s: invalid signal specification\n", spec)
+			status = 1
+			continue
+		}
+		trapsMu.Lock()
+		switch {
+		case reset:
+			delete(traps, name)
+			signal.Reset(sig)
+			if sig == syscall.SIGHUP && interactive {
+				catchHangup()
+			}
+		case action == "":
+			traps[name] = ""
+			signal.Ignore(sig)
+		default:
+			traps[name] = action
+			signal.Notify(signalCh, sig)
+		}
+		trapsMu.Unlock()
+	}
+	return status
+}
+
+func isUnsignedNumber(s string) bool {
+	_, err := strconv.ParseUint(s, 10, 32)
+	return err == nil
+}
+
+// listTraps prints the traps that are set, or those of the given signals,
+// as the trap commands that would set them again.
+func listTraps(args []string) string {
+	trapsMu.Lock()
+	defer trapsMu.Unlock()
+	var names []string
+	if len(args) > 1 {
+		for _, spec := range args[1:] {
+			if strings.ToUpper(spec) == "EXIT" || spec == "0" {
+				names = append(names, "EXIT")
+			} else if _, name, ok := parseSignal(spec); ok {
+				names = append(names, name)
+			}
+		}
+	} else {
+		for name := range traps {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+	}
+	var output strings.Builder
+	for _, name := range names {
+		if action, ok := traps[name]; ok {
+			sigName := "SIG" + name
+			if name == "EXIT" {
+				sigName = name
+			}
+			fmt.Fprintf(&output, "trap -- %s %s\n", shellSingleQuote(action), sigName)
+		}
+	}
+	return output.String()
+}
+
+func shellSingleQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
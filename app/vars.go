@@ -0,0 +1,614 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// shellArray holds an indexed or associative array. Indexed arrays are
+// sparse, so both kinds keep their keys as strings; indexed keys are kept in
+// numeric order and associative ones in the order they were first set.
+type shellArray struct {
+	assoc  bool
+	keys   []string
+	values map[string]string
+}
+
+// Scalar variables live in the environment, as they always have. Arrays
+// cannot be exported, so they are kept here instead.
+var arrays = map[string]*shellArray{}
+var arraysMu sync.Mutex
+
+var positionalParams = newArray(false)
+
+func newArray(assoc bool) *shellArray {
+	return &shellArray{assoc: assoc, values: make(map[string]string)}
+}
+
+func arrayFromList(list []string) *shellArray {
+	a := newArray(false)
+	a.appendValues(list...)
+	return a
+}
+
+func (a *shellArray) get(key string) (string, bool) {
+	value, ok := a.values[key]
+	return value, ok
+}
+
+func (a *shellArray) set(key, value string) {
+	if _, ok := a.values[key]; !ok {
+		if a.assoc {
+			a.keys = append(a.keys, key)
+		} else {
+			n, _ := strconv.Atoi(key)
+			i, _ := slices.BinarySearchFunc(a.keys, n, func(k string, n int) int {
+				kn, _ := strconv.Atoi(k)
+				return kn - n
+			})
+			a.keys = slices.Insert(a.keys, i, key)
+		}
+	}
+	a.values[key] = value
+}
+
+func (a *shellArray) unset(key string) {
+	if _, ok := a.values[key]; ok {
+		delete(a.values, key)
+		a.keys = slices.DeleteFunc(a.keys, func(k string) bool { return k == key })
+	}
+}
+
+func (a *shellArray) len() int {
+	return len(a.keys)
+}
+
+func (a *shellArray) list() []string {
+	list := make([]string, 0, len(a.keys))
+	for _, key := range a.keys {
+		list = append(list, a.values[key])
+	}
+	return list
+}
+
+func (a *shellArray) indices() []string {
+	return slices.Clone(a.keys)
+}
+
+func (a *shellArray) nextIndex() int {
+	if len(a.keys) == 0 {
+		return 0
+	}
+	last, _ := strconv.Atoi(a.keys[len(a.keys)-1])
+	return last + 1
+}
+
+func (a *shellArray) appendValues(values ...string) {
+	next := a.nextIndex()
+	for i, value := range values {
+		a.set(strconv.Itoa(next+i), value)
+	}
+}
+
+func (a *shellArray) clone() *shellArray {
+	c := &shellArray{assoc: a.assoc, keys: slices.Clone(a.keys), values: make(map[string]string, len(a.values))}
+	for key, value := range a.values {
+		c.values[key] = value
+	}
+	return c
+}
+
+// resolveKey turns an already expanded subscript into the key it names. For
+// indexed arrays the subscript may be a variable name, and negative indices
+// count back from the end.
+func (a *shellArray) resolveKey(subscript string) (string, bool) {
+	if a.assoc {
+		return subscript, true
+	}
+	n, ok := evalIndex(subscript)
+	if !ok {
+		return "", false
+	}
+	if n < 0 {
+		n += a.nextIndex()
+		if n < 0 {
+			return "", false
+		}
+	}
+	return strconv.Itoa(n), true
+}
+
+// evalIndex evaluates a numeric subscript or slice bound, which may be an
+// integer or the name of a variable holding one.
+func evalIndex(s string) (int, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, true
+	}
+	if isValidName(s) {
+		value, _ := lookupVar(s)
+		s = strings.TrimSpace(value)
+		if s == "" {
+			return 0, true
+		}
+	}
+	n, err := strconv.Atoi(s)
+	return n, err == nil
+}
+
+func getArray(name string) *shellArray {
+	arraysMu.Lock()
+	defer arraysMu.Unlock()
+	return arrays[name]
+}
+
+func setArray(name string, a *shellArray) {
+	arraysMu.Lock()
+	defer arraysMu.Unlock()
+	if a == nil {
+		delete(arrays, name)
+	} else {
+		arrays[name] = a
+	}
+}
+
+// snapshotArrays copies every array, for subshells to restore afterwards.
+func snapshotArrays() map[string]*shellArray {
+	arraysMu.Lock()
+	defer arraysMu.Unlock()
+	saved := make(map[string]*shellArray, len(arrays))
+	for name, a := range arrays {
+		saved[name] = a.clone()
+	}
+	return saved
+}
+
+func restoreArrays(saved map[string]*shellArray) {
+	arraysMu.Lock()
+	defer arraysMu.Unlock()
+	arrays = saved
+}
+
+// lookupVar returns the value of a variable. Naming an array without a
+// subscript refers to its element 0.
+func lookupVar(name string) (string, bool) {
+	if a := getArray(name); a != nil {
+		return a.get("0")
+	}
+	return os.LookupEnv(name)
+}
+
+func setVar(name, value string) {
+	if a := getArray(name); a != nil {
+		a.set("0", value)
+		return
+	}
+	os.Setenv(name, value)
+}
+
+func unsetVar(name string) {
+	setArray(name, nil)
+	os.Unsetenv(name)
+}
+
+// toArray returns the array called name, creating it (from a scalar of the
+// same name, if there is one) when it does not exist yet.
+func toArray(name string, assoc bool) *shellArray {
+	if a := getArray(name); a != nil {
+		return a
+	}
+	a := newArray(assoc)
+	if value, set := os.LookupEnv(name); set {
+		a.set("0", value)
+		os.Unsetenv(name)
+	}
+	setArray(name, a)
+	return a
+}
+
+// assignment is an expanded NAME=value, NAME[index]=value, NAME+=value or
+// NAME=(elements) word.
+type assignment struct {
+	name     string
+	index    string
+	hasIndex bool
+	appendOp bool
+	compound bool
+	value    string
+	keys     []string // explicit [key]= of each element, "" when absent
+	elements []string
+}
+
+func (a assignment) String() string {
+	var s strings.Builder
+	s.WriteString(a.name)
+	if a.hasIndex {
+		s.WriteString("[" + a.index + "]")
+	}
+	if a.appendOp {
+		s.WriteByte('+')
+	}
+	s.WriteByte('=')
+	if !a.compound {
+		s.WriteString(quoteIfNeeded(a.value))
+		return s.String()
+	}
+	s.WriteByte('(')
+	for i, element := range a.elements {
+		if i > 0 {
+			s.WriteByte(' ')
+		}
+		if a.keys[i] != "" {
+			s.WriteString("[" + quoteIfNeeded(a.keys[i]) + "]=")
+		}
+		s.WriteString(quoteIfNeeded(element))
+	}
+	s.WriteByte(')')
+	return s.String()
+}
+
+func (a assignment) apply() error {
+	switch {
+	case a.compound:
+		existing := getArray(a.name)
+		assoc := existing != nil && existing.assoc
+		arr := existing
+		if arr == nil || !a.appendOp {
+			arr = newArray(assoc)
+			if value, set := os.LookupEnv(a.name); set && a.appendOp {
+				arr.set("0", value)
+			}
+			os.Unsetenv(a.name)
+		}
+		next := arr.nextIndex()
+		for i := 0; i < len(a.elements); i++ {
+			key, value := a.keys[i], a.elements[i]
+			if key == "" && assoc {
+				key, value = value, ""
+				if i+1 < len(a.elements) {
+					i++
+					value = a.elements[i]
+				}
+			}
+			if key != "" {
+				resolved, ok := arr.resolveKey(key)
+				if !ok {
+					return fmt.Errorf("%s: bad array subscript", key)
+				}
+				key = resolved
+			} else {
+				key = strconv.Itoa(next)
+			}
+			if !assoc {
+				n, _ := strconv.Atoi(key)
+				next = n + 1
+			}
+			arr.set(key, value)
+		}
+		setArray(a.name, arr)
+	case a.hasIndex:
+		arr := toArray(a.name, false)
+		key, ok := arr.resolveKey(a.index)
+		if !ok || (arr.assoc && key == "") {
+			return fmt.Errorf("%s[%s]: bad array subscript", a.name, a.index)
+		}
+		value := a.value
+		if a.appendOp {
+			old, _ := arr.get(key)
+			value = old + value
+		}
+		arr.set(key, value)
+	default:
+		value := a.value
+		if a.appendOp {
+			if arr := getArray(a.name); arr != nil {
+				arr.appendValues(value)
+				return nil
+			}
+			old, _ := lookupVar(a.name)
+			value = old + value
+		}
+		setVar(a.name, value)
+	}
+	return nil
+}
+
+// splitAssignmentWord breaks an assignment word into its name, subscript
+// and value. ok is false when w is not an assignment.
+func splitAssignmentWord(w word) (name string, index word, hasIndex, appendOp bool, value word, ok bool) {
+	if len(w) == 0 || w[0].quote != 0 {
+		return
+	}
+	text := w[0].text
+	i := 0
+	for i < len(text) && isValidName(text[:i+1]) {
+		i++
+	}
+	name = text[:i]
+	if name == "" {
+		return
+	}
+	rest := append(word{{text: text[i:]}}, w[1:]...)
+	if strings.HasPrefix(rest[0].text, "[") {
+		rest[0].text = rest[0].text[1:]
+		index, rest, hasIndex = splitSubscript(rest)
+		if !hasIndex {
+			return
+		}
+	}
+	if len(rest) == 0 || rest[0].quote != 0 {
+		return
+	}
+	switch {
+	case strings.HasPrefix(rest[0].text, "+="):
+		appendOp = true
+		rest[0].text = rest[0].text[2:]
+	case strings.HasPrefix(rest[0].text, "="):
+		rest[0].text = rest[0].text[1:]
+	default:
+		return
+	}
+	return name, index, hasIndex, appendOp, rest, true
+}
+
+// splitSubscript reads parts up to the first unquoted ']' and returns them
+// along with what follows it.
+func splitSubscript(parts word) (subscript word, rest word, ok bool) {
+	for i, part := range parts {
+		if part.quote == 0 {
+			if j := strings.IndexByte(part.text, ']'); j != -1 {
+				if j > 0 {
+					subscript = append(subscript, wordPart{part.text[:j], 0})
+				}
+				rest = append(word{{text: part.text[j+1:]}}, parts[i+1:]...)
+				return subscript, rest, true
+			}
+		}
+		subscript = append(subscript, part)
+	}
+	return nil, nil, false
+}
+
+func isAssignment(w word) bool {
+	_, _, _, _, _, ok := splitAssignmentWord(w)
+	return ok
+}
+
+// expandAssignments expands the subscripts and values of assignment words.
+// A value written as (...) is an array, whose elements are expanded like
+// command arguments.
+func expandAssignments(assigns []word) (expanded []assignment) {
+	for _, w := range assigns {
+		name, index, hasIndex, appendOp, value, _ := splitAssignmentWord(w)
+		a := assignment{name: name, hasIndex: hasIndex, appendOp: appendOp}
+		if hasIndex {
+			a.index = expandString(index)
+		}
+		if text := value[0].text; !hasIndex && len(value) == 1 && value[0].quote == 0 && strings.HasPrefix(text, "(") && strings.HasSuffix(text, ")") {
+			a.compound = true
+			a.keys, a.elements = expandArrayElements(text[1 : len(text)-1])
+		} else {
+			a.value = expandString(value)
+		}
+		expanded = append(expanded, a)
+	}
+	return
+}
+
+func expandArrayElements(source string) (keys []string, elements []string) {
+	tokens, _ := commandParser(source)
+	for _, tok := range tokens {
+		if tok.kind != tokWord {
+			continue
+		}
+		w := tok.word
+		if w[0].quote == 0 && strings.HasPrefix(w[0].text, "[") {
+			rest := append(word{{text: w[0].text[1:]}}, w[1:]...)
+			if key, value, ok := splitSubscript(rest); ok && value[0].quote == 0 && strings.HasPrefix(value[0].text, "=") {
+				value[0].text = value[0].text[1:]
+				keys = append(keys, expandString(key))
+				elements = append(elements, expandString(value))
+				continue
+			}
+		}
+		for _, field := range expandWords([]word{w}) {
+			keys = append(keys, "")
+			elements = append(elements, field)
+		}
+	}
+	return
+}
+
+// applyAssignments sets each assignment and returns a function that puts
+// the previous values of scalars back, for assignments prefixed to a
+// command.
+func applyAssignments(assigns []assignment) (restore func()) {
+	type saved struct {
+		name, value string
+		set         bool
+	}
+	var previous []saved
+	for _, a := range assigns {
+		if !a.compound && !a.hasIndex && getArray(a.name) == nil {
+			old, set := os.LookupEnv(a.name)
+			previous = append(previous, saved{a.name, old, set})
+		}
+		if err := a.apply(); err != nil {
+			fmt.Fprintf(os.Stderr, "gosh: %s\n", err)
+			lastStatus = 1
+		}
+		if a.name == "PATH" {
+			resetHash()
+		}
+	}
+	return func() {
+		for i := len(previous) - 1; i >= 0; i-- {
+			if previous[i].set {
+				os.Setenv(previous[i].name, previous[i].value)
+			} else {
+				os.Unsetenv(previous[i].name)
+			}
+		}
+	}
+}
+
+func isDeclarationUtility(w word) bool {
+	return len(w) == 1 && w[0].quote == 0 && (w[0].text == "declare" || w[0].text == "typeset")
+}
+
+func Declare(command []string, assigns []assignment, std streams) int {
+	var assoc, indexed, display bool
+	var names []string
+	for _, arg := range command[1:] {
+		if len(arg) > 1 && arg[0] == '-' {
+			for _, c := range arg[1:] {
+				switch c {
+				case 'a':
+					indexed = true
+				case 'A':
+					assoc = true
+				case 'p':
+					display = true
+				default:
+					fmt.Fprintf(std.err, "declare: -%c: invalid option\n", c)
+					return 2
+				}
+			}
+		} else if eq := strings.IndexByte(arg, '='); eq > 0 {
+			assigns = append(assigns, assignment{name: arg[:eq], value: arg[eq+1:]})
+		} else {
+			names = append(names, arg)
+		}
+	}
+
+	status := 0
+	if display {
+		var output strings.Builder
+		if len(names) == 0 {
+			arraysMu.Lock()
+			for name := range arrays {
+				names = append(names, name)
+			}
+			arraysMu.Unlock()
+			slices.Sort(names)
+		}
+		for _, name := range names {
+			if decl, ok := declaration(name); ok {
+				output.WriteString(decl + "\n")
+			} else {
+				fmt.Fprintf(std.err, "declare: %s: not found\n", name)
+				status = 1
+			}
+		}
+		if std.print("declare", output.String()) != 0 {
+			return 1
+		}
+		return status
+	}
+
+	for _, a := range assigns {
+		names = append(names, a.name)
+	}
+	for _, name := range names {
+		if !isValidName(name) {
+			fmt.Fprintf(std.err, "declare: `%s': not a valid identifier\n", name)
+			status = 1
+			continue
+		}
+		existing := getArray(name)
+		if assoc && existing != nil && !existing.assoc {
+			fmt.Fprintf(std.err, "declare: %s: cannot convert indexed to associative array\n", name)
+			status = 1
+		} else if assoc && existing == nil {
+			os.Unsetenv(name)
+			setArray(name, newArray(true))
+		} else if indexed && existing == nil {
+			toArray(name, false)
+		}
+	}
+	// applyAssignments reports a failed assignment through lastStatus.
+	lastStatus = status
+	applyAssignments(assigns)
+	return lastStatus
+}
+
+// declaration formats a variable the way declare -p shows it.
+func declaration(name string) (string, bool) {
+	if a := getArray(name); a != nil {
+		flag := "-a"
+		if a.assoc {
+			flag = "-A"
+		}
+		var elements []string
+		for _, key := range a.keys {
+			elements = append(elements, fmt.Sprintf("[%s]=%s", quoteIfNeeded(key), doubleQuote(a.values[key])))
+		}
+		return fmt.Sprintf("declare %s %s=(%s)", flag, name, strings.Join(elements, " ")), true
+	}
+	if value, set := os.LookupEnv(name); set {
+		return fmt.Sprintf("declare -x %s=%s", name, doubleQuote(value)), true
+	}
+	return "", false
+}
+
+func doubleQuote(s string) string {
+	var quoted strings.Builder
+	quoted.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte("\"\\$`", s[i]) != -1 {
+			quoted.WriteByte('\\')
+		}
+		quoted.WriteByte(s[i])
+	}
+	quoted.WriteByte('"')
+	return quoted.String()
+}
+
+func Unset(command []string, std streams) int {
+	status := 0
+	functionsOnly := false
+	for _, arg := range command[1:] {
+		switch arg {
+		case "-f":
+			functionsOnly = true
+			continue
+		case "-v":
+			functionsOnly = false
+			continue
+		}
+		if functionsOnly {
+			delete(functions, arg)
+			continue
+		}
+		if open := strings.IndexByte(arg, '['); open > 0 && strings.HasSuffix(arg, "]") {
+			name, subscript := arg[:open], arg[open+1:len(arg)-1]
+			a := getArray(name)
+			if a == nil {
+				continue
+			}
+			if subscript == "@" || subscript == "*" {
+				setArray(name, nil)
+			} else if key, ok := a.resolveKey(subscript); ok {
+				a.unset(key)
+			} else {
+				fmt.Fprintf(std.err, "unset: %s: bad array subscript\n", arg)
+				status = 1
+			}
+			continue
+		}
+		if !isValidName(arg) {
+			fmt.Fprintf(std.err, "unset: `%s': not a valid identifier\n", arg)
+			status = 1
+			continue
+		}
+		if _, isVar := lookupVar(arg); !isVar && getArray(arg) == nil {
+			delete(functions, arg)
+		}
+		unsetVar(arg)
+	}
+	return status
+}